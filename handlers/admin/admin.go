@@ -0,0 +1,78 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"expvar"
+	"github.com/labstack/echo"
+	"github.com/lempiy/Signaller/room"
+	"net/http"
+	"strings"
+)
+
+//Authorize - allows request to the handler only with bearer token.
+func Authorize(token string, handler echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		auth := c.Request().Header.Get(echo.HeaderAuthorization)
+		provided := strings.TrimPrefix(auth, "Bearer ")
+		if token == "" || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			return echo.NewHTTPError(http.StatusUnauthorized)
+		}
+		return handler(c)
+	}
+}
+
+//Negotiations - returns offer/answer negotiation state of peer pairs.
+func Negotiations(cluster *room.Cluster) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		return c.JSON(http.StatusOK, cluster.Negotiations())
+	}
+}
+
+//SDP - returns summaries of the last relayed offers and answers.
+func SDP(cluster *room.Cluster) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		return c.JSON(http.StatusOK, cluster.SDPRecords())
+	}
+}
+
+//PolicyAudit - returns recent events rewritten or dropped by policies.
+func PolicyAudit(cluster *room.Cluster) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		return c.JSON(http.StatusOK, cluster.PolicyAudit())
+	}
+}
+
+//Quality - returns connection quality reported by clients per hub.
+func Quality(cluster *room.Cluster) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		return c.JSON(http.StatusOK, cluster.Quality())
+	}
+}
+
+//QualitySamples - returns raw stats samples of the hub from query.
+func QualitySamples(cluster *room.Cluster) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		hub := c.QueryParam("hub")
+		if hub == "" {
+			return echo.NewHTTPError(http.StatusBadRequest, "hub is required")
+		}
+		return c.JSON(http.StatusOK, cluster.QualitySamples(hub))
+	}
+}
+
+//Graph - returns peer connection graph of the hub from query or of
+//all hubs, as Graphviz DOT with format=dot.
+func Graph(cluster *room.Cluster) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		graphs := cluster.Graph(c.QueryParam("hub"))
+		if c.QueryParam("format") == "dot" {
+			return c.Blob(http.StatusOK, "text/vnd.graphviz; charset=UTF-8", []byte(room.GraphDOT(graphs)))
+		}
+		return c.JSON(http.StatusOK, graphs)
+	}
+}
+
+//Metrics - exposes expvar counters of the server.
+func Metrics() echo.HandlerFunc {
+	return echo.WrapHandler(expvar.Handler())
+}
@@ -2,11 +2,24 @@ package handlers
 
 import (
 	"github.com/labstack/echo"
+	"github.com/lempiy/Signaller/handlers/admin"
+	"github.com/lempiy/Signaller/handlers/ice"
 	"github.com/lempiy/Signaller/handlers/ws"
 	"github.com/lempiy/Signaller/room"
+	"os"
 )
 
 //Run - inits and fills app router with handlers.
 func Run(r *echo.Router, cluster *room.Cluster) {
 	r.Add("GET", "/ws", ws.Handle(cluster))
+	r.Add("GET", "/ice-servers", ice.Handle(cluster))
+
+	token := os.Getenv("ADMIN_TOKEN")
+	r.Add("GET", "/admin/negotiations", admin.Authorize(token, admin.Negotiations(cluster)))
+	r.Add("GET", "/admin/sdp", admin.Authorize(token, admin.SDP(cluster)))
+	r.Add("GET", "/admin/policy/audit", admin.Authorize(token, admin.PolicyAudit(cluster)))
+	r.Add("GET", "/admin/quality", admin.Authorize(token, admin.Quality(cluster)))
+	r.Add("GET", "/admin/quality/samples", admin.Authorize(token, admin.QualitySamples(cluster)))
+	r.Add("GET", "/admin/graph", admin.Authorize(token, admin.Graph(cluster)))
+	r.Add("GET", "/metrics", admin.Authorize(token, admin.Metrics()))
 }
@@ -0,0 +1,25 @@
+package ice
+
+import (
+	"github.com/labstack/echo"
+	"github.com/lempiy/Signaller/room"
+	"net/http"
+	"strings"
+)
+
+//Handle - returns ICE servers with TURN credentials for connected client,
+//request must carry bearer token received in EVENT_ICE_SERVERS.
+func Handle(cluster *room.Cluster) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		name := c.QueryParam("name")
+		if name == "" {
+			return echo.NewHTTPError(http.StatusBadRequest, "Client name cannot be empty")
+		}
+		auth := c.Request().Header.Get(echo.HeaderAuthorization)
+		servers, ok := cluster.SessionICEServers(name, strings.TrimPrefix(auth, "Bearer "))
+		if !ok {
+			return echo.NewHTTPError(http.StatusForbidden, "Client is not connected")
+		}
+		return c.JSON(http.StatusOK, servers)
+	}
+}
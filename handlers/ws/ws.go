@@ -35,6 +35,9 @@ const (
 
 	// Send pings to peer with this period. Must be less than pongWait.
 	pingPeriod = (pongWait * 9) / 10
+
+	// Relayed binary frames buffered for the peer, overflow closes the stream.
+	binaryBuffer = 64
 )
 
 func Handle(cluster *room.Cluster) echo.HandlerFunc {
@@ -59,7 +62,16 @@ func Handle(cluster *room.Cluster) echo.HandlerFunc {
 			return nil
 		}
 
-		if c := cluster.General.Get(name); c != nil {
+		if cluster.IsReserved(name) {
+			ws.WriteMessage(websocket.CloseMessage,
+				websocket.FormatCloseMessage(4001, "Client name is reserved"),
+			)
+			ws.Close()
+			return nil
+		}
+
+		// ownership is bound to the name, so it must be unique in the cluster
+		if c := cluster.FindClient(name); c != nil {
 			ws.WriteMessage(websocket.CloseMessage,
 				websocket.FormatCloseMessage(4001, "Client already exists"),
 			)
@@ -69,21 +81,44 @@ func Handle(cluster *room.Cluster) echo.HandlerFunc {
 		}
 
 		send := make(chan []byte)
+		binary := make(chan []byte, binaryBuffer)
 		read := make(chan []byte)
 		die := make(chan struct{})
 
 		if space != "" {
 			if hub = cluster.Get(space); hub == nil {
 				log.Printf("Hub with ID %s not found in the cluster, it will be created", space)
-				hub = room.NewHub(space, cluster)
+				hub = room.NewHubWithOptions(space, cluster, room.HubOptions{
+					Owners: []string{name},
+				})
 				cluster.Add(hub)
 			} else {
 				log.Printf("Found hub with ID %s hub length before connection %d", space, hub.Length())
-				if c := hub.Get(name); c != nil {
+				credentials := room.Credentials{
+					Password: c.QueryParam("password"),
+					Token:    c.QueryParam("token"),
+				}
+				if err := hub.Authorize(name, credentials); err != nil {
 					ws.WriteMessage(websocket.CloseMessage,
-						websocket.FormatCloseMessage(4001, "Client already exists"),
+						websocket.FormatCloseMessage(4003, err.Error()),
 					)
-					log.Printf("Client with name %s already exist on hub %s", name, hub.ID)
+					log.Printf("Client %s denied access to hub %s: %s", name, hub.ID, err)
+					ws.Close()
+					return nil
+				}
+				if !hub.HasSpace() {
+					ws.WriteMessage(websocket.CloseMessage,
+						websocket.FormatCloseMessage(4003, "Hub is full"),
+					)
+					log.Printf("Hub %s is full, client %s rejected", hub.ID, name)
+					ws.Close()
+					return nil
+				}
+				if err := hub.Admit(name, credentials); err != nil {
+					ws.WriteMessage(websocket.CloseMessage,
+						websocket.FormatCloseMessage(4003, err.Error()),
+					)
+					log.Printf("Client %s denied access to hub %s: %s", name, hub.ID, err)
 					ws.Close()
 					return nil
 				}
@@ -93,7 +128,10 @@ func Handle(cluster *room.Cluster) echo.HandlerFunc {
 		}
 
 		client = room.NewClient(send, read, die, name)
+		client.UseBinary(binary)
 		hub.Add(client)
+		go cluster.PushICEServers(client)
+		go cluster.PushRecordingState(client)
 		deadRead := make(chan struct{})
 		log.Printf("Client %s connected to hub %s", name, hub.ID)
 		go func() {
@@ -104,14 +142,14 @@ func Handle(cluster *room.Cluster) echo.HandlerFunc {
 				return nil
 			})
 			for {
-				_, message, err := ws.ReadMessage()
+				kind, message, err := ws.ReadMessage()
 				if err != nil {
 					hub = client.Hub
 					if websocket.IsCloseError(err, closeErrorCodes...) {
 						ws.Close()
 						client.Die()
 						log.Printf("Hub with ID %s has length %d", hub.ID, hub.Length())
-						if hub.Length() == 0 && hub != cluster.General {
+						if hub.Length() == 0 && hub != cluster.General && !hub.HasBreakouts() {
 							cluster.Remove(hub.ID)
 							hub.Die()
 						}
@@ -121,13 +159,19 @@ func Handle(cluster *room.Cluster) echo.HandlerFunc {
 					ws.Close()
 					client.Die()
 					log.Printf("Hub with ID %s has length %d", hub.ID, hub.Length())
-					if hub.Length() == 0 && hub != cluster.General {
+					if hub.Length() == 0 && hub != cluster.General && !hub.HasBreakouts() {
 						cluster.Remove(hub.ID)
 						hub.Die()
 					}
 					deadRead <- struct{}{}
 					return
 				}
+				if kind == websocket.BinaryMessage {
+					// relayed data is consumed in place without blocking,
+					// the sender is told about frames which weren't relayed
+					room.ConsumeRelayFrame(client, message)
+					continue
+				}
 				read <- message
 			}
 		}()
@@ -140,6 +184,12 @@ func Handle(cluster *room.Cluster) echo.HandlerFunc {
 				if err != nil {
 					log.Println(err)
 				}
+			case data := <-binary:
+				ws.SetWriteDeadline(time.Now().Add(writeWait))
+				err := ws.WriteMessage(websocket.BinaryMessage, data)
+				if err != nil {
+					log.Println(err)
+				}
 			case <-deadRead:
 				return err
 			case <-ticker.C:
@@ -150,7 +200,7 @@ func Handle(cluster *room.Cluster) echo.HandlerFunc {
 					ws.Close()
 					client.Die()
 					log.Printf("Hub with ID %s has length %d", hub.ID, hub.Length())
-					if hub.Length() == 0 && hub != cluster.General {
+					if hub.Length() == 0 && hub != cluster.General && !hub.HasBreakouts() {
 						cluster.Remove(hub.ID)
 						hub.Die()
 					}
@@ -0,0 +1,81 @@
+package nat
+
+import (
+	"sync"
+	"time"
+)
+
+//Bucket - token bucket limiting bytes per second, zero rate means
+//unlimited.
+type Bucket struct {
+	mx     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func NewBucket(rate int) *Bucket {
+	return &Bucket{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+func (b *Bucket) fill() {
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+}
+
+//Fits - reports whether n tokens may ever be taken at once.
+func (b *Bucket) Fits(n int) bool {
+	return b.rate <= 0 || float64(n) <= b.rate
+}
+
+//Allow - takes n tokens if there is enough of them.
+func (b *Bucket) Allow(n int) bool {
+	if b.rate <= 0 {
+		return true
+	}
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	b.fill()
+	if b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+//Delay - returns time until n tokens are available, nothing is taken.
+func (b *Bucket) Delay(n int) time.Duration {
+	if b.rate <= 0 {
+		return 0
+	}
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	b.fill()
+	if b.tokens >= float64(n) {
+		return 0
+	}
+	return time.Duration((float64(n) - b.tokens) / b.rate * float64(time.Second))
+}
+
+//Wait - takes n tokens, returns time to wait until they are refilled.
+func (b *Bucket) Wait(n int) time.Duration {
+	if b.rate <= 0 {
+		return 0
+	}
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	b.fill()
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
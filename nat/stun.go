@@ -0,0 +1,82 @@
+package nat
+
+import (
+	"expvar"
+	"github.com/pion/stun/v3"
+	"log"
+	"net"
+)
+
+const (
+	Software = "Signaller"
+
+	stunBufferSize = 1500
+)
+
+var stunMetrics = expvar.NewMap("stun")
+
+//STUNServer - RFC 5389 server answering binding requests over UDP.
+type STUNServer struct {
+	conn net.PacketConn
+}
+
+//ListenSTUN - opens UDP socket for STUN server on the address.
+func ListenSTUN(address string) (*STUNServer, error) {
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("STUN server listens on %s", conn.LocalAddr())
+	return &STUNServer{conn: conn}, nil
+}
+
+//Serve - answers requests until the server is closed.
+func (s *STUNServer) Serve() error {
+	buf := make([]byte, stunBufferSize)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		if err := s.handle(buf[:n], addr); err != nil {
+			stunMetrics.Add("errors", 1)
+			log.Println("STUN", addr, err)
+		}
+	}
+}
+
+func (s *STUNServer) handle(data []byte, addr net.Addr) error {
+	if !stun.IsMessage(data) {
+		stunMetrics.Add("ignored", 1)
+		return nil
+	}
+	request := &stun.Message{Raw: data}
+	if err := request.Decode(); err != nil {
+		return err
+	}
+	if request.Type != stun.BindingRequest {
+		stunMetrics.Add("ignored", 1)
+		return nil
+	}
+	stunMetrics.Add("requests", 1)
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return nil
+	}
+	response, err := stun.Build(
+		stun.NewTransactionIDSetter(request.TransactionID),
+		stun.BindingSuccess,
+		&stun.XORMappedAddress{IP: udpAddr.IP, Port: udpAddr.Port},
+		stun.NewSoftware(Software),
+		stun.Fingerprint,
+	)
+	if err != nil {
+		return err
+	}
+	_, err = s.conn.WriteTo(response.Raw, addr)
+	return err
+}
+
+func (s *STUNServer) Close() error {
+	return s.conn.Close()
+}
@@ -0,0 +1,355 @@
+package nat
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"expvar"
+	"github.com/pion/stun/v3"
+	"github.com/pion/turn/v4"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultRealm          = "signaller"
+	DefaultMaxAllocations = 5
+)
+
+var turnMetrics = expvar.NewMap("turn")
+
+//TURNConfig - settings of embedded TURN server.
+type TURNConfig struct {
+	Address        string
+	RelayIP        net.IP
+	Realm          string
+	Secret         string
+	MaxAllocations int
+	//Bandwidth - bytes per second allowed for a client in each direction,
+	//zero means unlimited.
+	Bandwidth int
+	//IsConnected - reports whether client with the name has live websocket.
+	IsConnected func(name string) bool
+}
+
+//TURNPassword - returns credential of the TURN REST API username,
+//which is base64 encoded HMAC-SHA1 of the username with shared secret.
+func TURNPassword(secret string, username string) string {
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+//turnClient - allocations and traffic of single Signaller client.
+type turnClient struct {
+	name        string
+	allocations map[string]time.Time
+	conns       map[string]net.Conn
+	in          *Bucket
+	out         *Bucket
+}
+
+//TURNServer - TURN relay accepting credentials issued to connected
+//clients, allocations are revoked when client's websocket dies.
+type TURNServer struct {
+	config  TURNConfig
+	server  *turn.Server
+	mx      sync.Mutex
+	clients map[string]*turnClient
+	byAddr  map[string]*turnClient
+	revoked map[string]time.Time
+}
+
+//ListenTURN - starts TURN server on UDP and TCP address. TCP is only
+//the transport between client and server, relayed allocations are UDP:
+//TCP allocations (RFC 6062) aren't supported by pion/turn server.
+func ListenTURN(config TURNConfig) (*TURNServer, error) {
+	if config.Realm == "" {
+		config.Realm = DefaultRealm
+	}
+	if config.MaxAllocations <= 0 {
+		config.MaxAllocations = DefaultMaxAllocations
+	}
+	s := &TURNServer{
+		config:  config,
+		clients: make(map[string]*turnClient),
+		byAddr:  make(map[string]*turnClient),
+		revoked: make(map[string]time.Time),
+	}
+	udp, err := net.ListenPacket("udp4", config.Address)
+	if err != nil {
+		return nil, err
+	}
+	tcp, err := net.Listen("tcp4", config.Address)
+	if err != nil {
+		udp.Close()
+		return nil, err
+	}
+	s.server, err = turn.NewServer(turn.ServerConfig{
+		Realm:       config.Realm,
+		AuthHandler: s.authenticate,
+		PacketConnConfigs: []turn.PacketConnConfig{{
+			PacketConn:            &turnPacketConn{PacketConn: udp, server: s},
+			RelayAddressGenerator: s.relayGenerator(),
+		}},
+		ListenerConfigs: []turn.ListenerConfig{{
+			Listener:              &turnListener{Listener: tcp, server: s},
+			RelayAddressGenerator: s.relayGenerator(),
+		}},
+	})
+	if err != nil {
+		udp.Close()
+		tcp.Close()
+		return nil, err
+	}
+	log.Printf("TURN server listens on %s, relays via %s", config.Address, config.RelayIP)
+	return s, nil
+}
+
+func (s *TURNServer) relayGenerator() turn.RelayAddressGenerator {
+	return &turn.RelayAddressGeneratorStatic{
+		RelayAddress: s.config.RelayIP,
+		Address:      "0.0.0.0",
+	}
+}
+
+//authenticate - validates TURN REST API username "expiry:name", the
+//name must belong to connected client which has allocation quota left.
+func (s *TURNServer) authenticate(username, realm string, addr net.Addr) ([]byte, bool) {
+	parts := strings.SplitN(username, ":", 2)
+	if len(parts) != 2 {
+		return nil, false
+	}
+	expiry, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || time.Now().Unix() > expiry {
+		turnMetrics.Add("auth_expired", 1)
+		return nil, false
+	}
+	name := parts[1]
+	if s.config.IsConnected != nil && !s.config.IsConnected(name) {
+		turnMetrics.Add("auth_rejected", 1)
+		return nil, false
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if _, ok := s.revoked[addr.String()]; ok {
+		return nil, false
+	}
+	c := s.client(name)
+	key := addr.String()
+	if _, ok := c.allocations[key]; !ok && c.live() >= s.config.MaxAllocations {
+		// request from address without allocation is a new allocation
+		turnMetrics.Add("quota_rejected", 1)
+		return nil, false
+	}
+	s.byAddr[key] = c
+	return turn.GenerateAuthKey(username, realm, TURNPassword(s.config.Secret, username)), true
+}
+
+func (s *TURNServer) client(name string) *turnClient {
+	c := s.clients[name]
+	if c == nil {
+		c = &turnClient{
+			name:        name,
+			allocations: make(map[string]time.Time),
+			conns:       make(map[string]net.Conn),
+			in:          NewBucket(s.config.Bandwidth),
+			out:         NewBucket(s.config.Bandwidth),
+		}
+		s.clients[name] = c
+	}
+	return c
+}
+
+func (c *turnClient) live() int {
+	now := time.Now()
+	count := 0
+	for key, expiresAt := range c.allocations {
+		if now.After(expiresAt) {
+			delete(c.allocations, key)
+			continue
+		}
+		count++
+	}
+	return count
+}
+
+//observe - tracks allocation lifetime from server responses to addr.
+func (s *TURNServer) observe(data []byte, addr net.Addr) {
+	if !stun.IsMessage(data) {
+		return
+	}
+	m := &stun.Message{Raw: append([]byte(nil), data...)}
+	if err := m.Decode(); err != nil || m.Type.Class != stun.ClassSuccessResponse {
+		return
+	}
+	if m.Type.Method != stun.MethodAllocate && m.Type.Method != stun.MethodRefresh {
+		return
+	}
+	raw, err := m.Get(stun.AttrLifetime)
+	if err != nil || len(raw) != 4 {
+		return
+	}
+	lifetime := time.Duration(binary.BigEndian.Uint32(raw)) * time.Second
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	c := s.byAddr[addr.String()]
+	if c == nil {
+		return
+	}
+	if lifetime == 0 {
+		delete(c.allocations, addr.String())
+		return
+	}
+	if m.Type.Method == stun.MethodAllocate {
+		turnMetrics.Add("allocations", 1)
+	}
+	c.allocations[addr.String()] = time.Now().Add(lifetime)
+}
+
+//lookup - returns owner of the address, ok is false for revoked ones.
+func (s *TURNServer) lookup(addr net.Addr) (*turnClient, bool) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	key := addr.String()
+	if expiresAt, ok := s.revoked[key]; ok {
+		if time.Now().Before(expiresAt) {
+			return nil, false
+		}
+		delete(s.revoked, key)
+	}
+	return s.byAddr[key], true
+}
+
+func (s *TURNServer) track(conn net.Conn) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if c := s.byAddr[conn.RemoteAddr().String()]; c != nil {
+		c.conns[conn.RemoteAddr().String()] = conn
+	}
+}
+
+//Revoke - drops all allocations of the client with the name.
+func (s *TURNServer) Revoke(name string) {
+	s.mx.Lock()
+	c := s.clients[name]
+	if c == nil {
+		s.mx.Unlock()
+		return
+	}
+	delete(s.clients, name)
+	// allocations can't outlive their lifetime, so it's enough to keep
+	// addresses blocked for the maximum one
+	until := time.Now().Add(time.Hour)
+	for key, client := range s.byAddr {
+		if client == c {
+			delete(s.byAddr, key)
+			s.revoked[key] = until
+		}
+	}
+	conns := c.conns
+	s.mx.Unlock()
+	for _, conn := range conns {
+		conn.Close()
+	}
+	if len(c.allocations) > 0 {
+		turnMetrics.Add("revoked", int64(len(c.allocations)))
+		log.Printf("TURN allocations of client %s revoked", name)
+	}
+}
+
+func (s *TURNServer) Close() error {
+	return s.server.Close()
+}
+
+//turnPacketConn - UDP socket of the server which enforces revocation
+//and bandwidth limits of clients.
+type turnPacketConn struct {
+	net.PacketConn
+	server *TURNServer
+}
+
+func (conn *turnPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := conn.PacketConn.ReadFrom(p)
+		if err != nil {
+			return n, addr, err
+		}
+		c, ok := conn.server.lookup(addr)
+		if !ok || (c != nil && !c.in.Allow(n)) {
+			turnMetrics.Add("dropped", 1)
+			continue
+		}
+		turnMetrics.Add("bytes_in", int64(n))
+		return n, addr, err
+	}
+}
+
+func (conn *turnPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c, ok := conn.server.lookup(addr)
+	if !ok || (c != nil && !c.out.Allow(len(p))) {
+		turnMetrics.Add("dropped", 1)
+		return len(p), nil
+	}
+	conn.server.observe(p, addr)
+	turnMetrics.Add("bytes_out", int64(len(p)))
+	return conn.PacketConn.WriteTo(p, addr)
+}
+
+type turnListener struct {
+	net.Listener
+	server *TURNServer
+}
+
+func (l *turnListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &turnConn{Conn: conn, server: l.server}, nil
+}
+
+//turnConn - TCP connection of a client, stream can't drop packets so
+//exceeded bandwidth is throttled instead.
+type turnConn struct {
+	net.Conn
+	server  *TURNServer
+	tracked bool
+}
+
+func (conn *turnConn) Read(p []byte) (int, error) {
+	n, err := conn.Conn.Read(p)
+	c, ok := conn.server.lookup(conn.RemoteAddr())
+	if !ok {
+		conn.Conn.Close()
+		return 0, net.ErrClosed
+	}
+	if c != nil {
+		time.Sleep(c.in.Wait(n))
+	}
+	turnMetrics.Add("bytes_in", int64(n))
+	return n, err
+}
+
+func (conn *turnConn) Write(p []byte) (int, error) {
+	c, ok := conn.server.lookup(conn.RemoteAddr())
+	if !ok {
+		conn.Conn.Close()
+		return 0, net.ErrClosed
+	}
+	if c != nil {
+		if !conn.tracked {
+			conn.server.track(conn)
+			conn.tracked = true
+		}
+		time.Sleep(c.out.Wait(len(p)))
+	}
+	conn.server.observe(p, conn.RemoteAddr())
+	turnMetrics.Add("bytes_out", int64(len(p)))
+	return conn.Conn.Write(p)
+}
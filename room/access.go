@@ -0,0 +1,199 @@
+package room
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"sync"
+	"time"
+)
+
+const (
+	ACCESS_OPEN     = "open"
+	ACCESS_PASSWORD = "password"
+	ACCESS_INVITE   = "invite"
+
+	ROLE_OWNER  = "owner"
+	ROLE_MEMBER = "member"
+
+	InviteTokenLength = 16
+	DefaultInviteTTL  = time.Hour
+	MaxInviteTTL      = time.Hour * 24 * 7
+	MaxPasswordLength = 72
+)
+
+var (
+	ErrWrongPassword = errors.New("wrong hub password")
+	ErrInvalidToken  = errors.New("invite token is invalid or expired")
+)
+
+type invite struct {
+	expiresAt time.Time
+	usesLeft  int
+}
+
+//InviteTokens - expiring invite tokens minted for a hub.
+type InviteTokens struct {
+	mx     sync.Mutex
+	tokens map[string]*invite
+}
+
+func NewInviteTokens() *InviteTokens {
+	return &InviteTokens{
+		tokens: make(map[string]*invite),
+	}
+}
+
+//Mint - creates new token valid for ttl, maxUses of 0 means unlimited uses.
+func (t *InviteTokens) Mint(ttl time.Duration, maxUses int) (string, time.Time) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	t.collect()
+	token := secureToken(InviteTokenLength)
+	expiresAt := time.Now().Add(ttl)
+	t.tokens[token] = &invite{
+		expiresAt: expiresAt,
+		usesLeft:  maxUses,
+	}
+	return token, expiresAt
+}
+
+//Valid - checks token without spending it.
+func (t *InviteTokens) Valid(token string) bool {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	inv := t.tokens[token]
+	return inv != nil && !time.Now().After(inv.expiresAt)
+}
+
+//Use - validates token and spends one of its uses.
+func (t *InviteTokens) Use(token string) bool {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	inv := t.tokens[token]
+	if inv == nil {
+		return false
+	}
+	if time.Now().After(inv.expiresAt) {
+		delete(t.tokens, token)
+		return false
+	}
+	if inv.usesLeft > 0 {
+		inv.usesLeft--
+		if inv.usesLeft == 0 {
+			delete(t.tokens, token)
+		}
+	}
+	return true
+}
+
+//Revoke - invalidates token before its expiration.
+func (t *InviteTokens) Revoke(token string) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	delete(t.tokens, token)
+}
+
+func (t *InviteTokens) collect() {
+	now := time.Now()
+	for token, inv := range t.tokens {
+		if now.After(inv.expiresAt) {
+			delete(t.tokens, token)
+		}
+	}
+}
+
+//Credentials - secrets presented by a client joining a hub.
+type Credentials struct {
+	Password string `json:"password,omitempty"`
+	Token    string `json:"token,omitempty"`
+}
+
+//IsOwner - reports whether client with the name owns the hub.
+func (hub *Hub) IsOwner(name string) bool {
+	return containsString(hub.Options.Owners, name)
+}
+
+//RoleOf - returns role of client with the name in the hub.
+func (hub *Hub) RoleOf(name string) string {
+	if hub.IsOwner(name) {
+		return ROLE_OWNER
+	}
+	if hub.Options.Stage {
+		if hub.stage.has(name) {
+			return ROLE_PUBLISHER
+		}
+		return ROLE_VIEWER
+	}
+	return ROLE_MEMBER
+}
+
+//Authorize - checks whether client with the name may join the hub.
+//Owners are always allowed, valid invite token passes any access mode.
+//The token isn't spent until the client is admitted.
+func (hub *Hub) Authorize(name string, credentials Credentials) error {
+	return hub.authorize(name, credentials, hub.invites.Valid)
+}
+
+//Admit - spends invite token of authorized client once nothing else can
+//keep it out of the hub, fails if the token was spent meanwhile.
+func (hub *Hub) Admit(name string, credentials Credentials) error {
+	return hub.authorize(name, credentials, hub.invites.Use)
+}
+
+func (hub *Hub) authorize(name string, credentials Credentials, token func(string) bool) error {
+	if hub.IsOwner(name) {
+		return nil
+	}
+	if credentials.Token != "" && token(credentials.Token) {
+		return nil
+	}
+	switch hub.Options.Access {
+	case ACCESS_PASSWORD:
+		if hub.checkPassword(credentials.Password) {
+			return nil
+		}
+		if credentials.Token != "" {
+			return ErrInvalidToken
+		}
+		return ErrWrongPassword
+	case ACCESS_INVITE:
+		return ErrInvalidToken
+	}
+	return nil
+}
+
+func (hub *Hub) checkPassword(password string) bool {
+	if hub.passwordHash == nil {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword(hub.passwordHash, []byte(password)) == nil
+}
+
+//ValidateAccess - checks access settings of hub to be created, password
+//mode requires a password bcrypt can hash.
+func (options HubOptions) ValidateAccess() error {
+	switch options.Access {
+	case "", ACCESS_OPEN, ACCESS_INVITE:
+	case ACCESS_PASSWORD:
+		if options.Password == "" {
+			return errors.New("Password is required for password access")
+		}
+	default:
+		return fmt.Errorf("Unknown access mode %s", options.Access)
+	}
+	if len(options.Password) > MaxPasswordLength {
+		return fmt.Errorf("Password must not be longer than %d bytes", MaxPasswordLength)
+	}
+	return nil
+}
+
+func secureToken(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return randomId(n * 2)
+	}
+	return hex.EncodeToString(b)
+}
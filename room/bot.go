@@ -0,0 +1,477 @@
+package room
+
+import (
+	"errors"
+	"fmt"
+	"github.com/json-iterator/go"
+	"github.com/pion/interceptor"
+	"github.com/pion/webrtc/v4"
+	"log"
+	"sync"
+)
+
+const (
+	DefaultBotName = "signaller"
+)
+
+//DataHandler - receives message of data channel opened by a client
+//towards the bot.
+type DataHandler func(peer *BotPeer, label string, data []byte)
+
+//BotDescriptionPayload - offer or answer sent by the bot.
+type BotDescriptionPayload struct {
+	From string                    `json:"from"`
+	SDP  webrtc.SessionDescription `json:"sdp"`
+}
+
+//BotCandidatePayload - ICE candidate trickled by the bot.
+type BotCandidatePayload struct {
+	From      string                  `json:"from"`
+	Candidate webrtc.ICECandidateInit `json:"candidate"`
+}
+
+//BotPeer - server side peer connection with a single client.
+type BotPeer struct {
+	Name string
+	Hub  string
+
+	bot      *Bot
+	pc       *webrtc.PeerConnection
+	mx       sync.Mutex
+	session  string
+	channels map[string]*webrtc.DataChannel
+	pending  []webrtc.ICECandidateInit
+
+	renegotiate bool
+	reporting   bool
+}
+
+//botError - rejection of the offer with specific error code.
+type botError struct {
+	code int
+	info string
+}
+
+func (err *botError) Error() string {
+	return err.info
+}
+
+//botHooks - media handling of specialized bots.
+type botHooks struct {
+	//admit - rejects offer of the client with returned error.
+	admit        func(c *Client) error
+	beforeAnswer func(peer *BotPeer)
+	answered     func(peer *BotPeer)
+	track        func(peer *BotPeer, remote *webrtc.TrackRemote, receiver *webrtc.RTPReceiver)
+	connected    func(peer *BotPeer)
+	dropped      func(peer *BotPeer)
+}
+
+//Bot - WebRTC participant answering offers sent to the reserved name
+//and terminating data channels on the server.
+type Bot struct {
+	Name     string
+	cluster  *Cluster
+	api      *webrtc.API
+	hooks    botHooks
+	mx       sync.RWMutex
+	peers    map[string]*BotPeer
+	handlers map[string]DataHandler
+}
+
+func NewBot(name string, cluster *Cluster) *Bot {
+	if name == "" {
+		name = DefaultBotName
+	}
+	return &Bot{
+		Name:     name,
+		cluster:  cluster,
+		api:      webrtc.NewAPI(),
+		peers:    make(map[string]*BotPeer),
+		handlers: make(map[string]DataHandler),
+	}
+}
+
+//newMediaAPI - returns WebRTC API with default codecs and interceptors
+//for bots exchanging audio and video.
+func newMediaAPI() (*webrtc.API, error) {
+	media := &webrtc.MediaEngine{}
+	if err := media.RegisterDefaultCodecs(); err != nil {
+		return nil, err
+	}
+	registry := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(media, registry); err != nil {
+		return nil, err
+	}
+	return webrtc.NewAPI(webrtc.WithMediaEngine(media), webrtc.WithInterceptorRegistry(registry)), nil
+}
+
+//Handle - registers handler of data channels with the label, empty
+//label handles channels without own handler.
+func (bot *Bot) Handle(label string, handler DataHandler) {
+	bot.mx.Lock()
+	defer bot.mx.Unlock()
+	bot.handlers[label] = handler
+}
+
+//Peer - returns connection with the client.
+func (bot *Bot) Peer(name string) *BotPeer {
+	bot.mx.RLock()
+	defer bot.mx.RUnlock()
+	return bot.peers[name]
+}
+
+//Peers - returns connections with clients of the hub.
+func (bot *Bot) Peers(hubID string) []*BotPeer {
+	bot.mx.RLock()
+	defer bot.mx.RUnlock()
+	var result []*BotPeer
+	for _, peer := range bot.peers {
+		if peer.Hub == hubID {
+			result = append(result, peer)
+		}
+	}
+	return result
+}
+
+//Broadcast - sends data to the channel with the label of every client
+//of the hub connected to the bot.
+func (bot *Bot) Broadcast(hubID string, label string, data []byte) {
+	for _, peer := range bot.Peers(hubID) {
+		if err := peer.Send(label, data); err != nil {
+			log.Printf("Bot broadcast to %s: %s", peer.Name, err)
+		}
+	}
+}
+
+func (bot *Bot) handler(label string) DataHandler {
+	bot.mx.RLock()
+	defer bot.mx.RUnlock()
+	if handler := bot.handlers[label]; handler != nil {
+		return handler
+	}
+	return bot.handlers[""]
+}
+
+//connect - returns connection with the client, creates it if needed.
+func (bot *Bot) connect(c *Client) (*BotPeer, error) {
+	bot.mx.Lock()
+	defer bot.mx.Unlock()
+	if peer := bot.peers[c.Name]; peer != nil {
+		return peer, nil
+	}
+	servers, _ := bot.cluster.ice.Servers(bot.Name)
+	config := webrtc.Configuration{}
+	for _, server := range servers {
+		config.ICEServers = append(config.ICEServers, webrtc.ICEServer{
+			URLs:       server.URLs,
+			Username:   server.Username,
+			Credential: server.Credential,
+		})
+	}
+	pc, err := bot.api.NewPeerConnection(config)
+	if err != nil {
+		return nil, err
+	}
+	peer := &BotPeer{
+		Name:     c.Name,
+		Hub:      c.Hub.ID,
+		bot:      bot,
+		pc:       pc,
+		channels: make(map[string]*webrtc.DataChannel),
+	}
+	pc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		if candidate != nil {
+			peer.sendCandidate(candidate.ToJSON())
+		}
+	})
+	pc.OnDataChannel(peer.attach)
+	if bot.hooks.track != nil {
+		pc.OnTrack(func(remote *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+			bot.hooks.track(peer, remote, receiver)
+		})
+	}
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		log.Printf("Bot %s connection with %s is %s", bot.Name, peer.Name, state)
+		switch state {
+		case webrtc.PeerConnectionStateConnected:
+			if bot.hooks.connected != nil {
+				go bot.hooks.connected(peer)
+			}
+		case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+			bot.drop(peer.Name)
+		}
+	})
+	bot.peers[c.Name] = peer
+	return peer, nil
+}
+
+//drop - closes connection with the client.
+func (bot *Bot) drop(name string) {
+	bot.mx.Lock()
+	peer := bot.peers[name]
+	delete(bot.peers, name)
+	bot.mx.Unlock()
+	if peer != nil {
+		peer.pc.Close()
+		if bot.hooks.dropped != nil {
+			bot.hooks.dropped(peer)
+		}
+	}
+}
+
+//consume - handles offer, answer or candidate sent by c to the bot.
+func (bot *Bot) consume(c *Client, event Event) {
+	var payload interface{}
+	if event.Payload == nil {
+		return
+	}
+	if err := jsoniter.Unmarshal(*event.Payload, &payload); err != nil {
+		log.Println("Bot consume", err)
+		return
+	}
+	switch event.Action {
+	case EVENT_OFFER_CONNECTION:
+		desc := findDescription(payload)
+		if desc == nil {
+			invalidSDP(c, errors.New("no session description in payload"), event.Id)
+			return
+		}
+		if bot.hooks.admit != nil {
+			if err := bot.hooks.admit(c); err != nil {
+				code := ERROR_BOT_FAILED
+				if rejection, ok := err.(*botError); ok {
+					code = rejection.code
+				}
+				sendError(c, event.Id, code, err.Error())
+				return
+			}
+		}
+		peer, err := bot.connect(c)
+		if err != nil {
+			sendError(c, event.Id, ERROR_BOT_FAILED, fmt.Sprintf("Bot connection failed: %s", err))
+			return
+		}
+		if err := peer.answer(desc["sdp"].(string), event.Session); err != nil {
+			invalidSDP(c, err, event.Id)
+			bot.drop(c.Name)
+		}
+	case EVENT_ANSWER_CONNECTION:
+		desc := findDescription(payload)
+		peer := bot.Peer(c.Name)
+		if desc == nil || peer == nil {
+			return
+		}
+		if err := peer.accept(desc["sdp"].(string)); err != nil {
+			invalidSDP(c, err, event.Id)
+		}
+	case EVENT_CANDIDATE_CONNECTION:
+		node := findCandidate(payload)
+		peer := bot.Peer(c.Name)
+		if node == nil || peer == nil {
+			return
+		}
+		var candidate webrtc.ICECandidateInit
+		bts, _ := jsoniter.Marshal(node)
+		if err := jsoniter.Unmarshal(bts, &candidate); err != nil {
+			log.Println("Bot consume", err)
+			return
+		}
+		peer.addCandidate(candidate)
+	}
+}
+
+//answer - replies to offer of the client. Pending offer of the bot is
+//rolled back, so the client always wins the collision and the bot
+//offers again afterwards.
+func (peer *BotPeer) answer(offer string, session string) error {
+	if err := peer.applyOffer(offer, session); err != nil {
+		return err
+	}
+	if hook := peer.bot.hooks.answered; hook != nil {
+		hook(peer)
+	}
+	peer.resume()
+	return nil
+}
+
+//applyOffer - applies remote offer, candidates received before it are
+//added afterwards.
+func (peer *BotPeer) applyOffer(offer string, session string) error {
+	peer.mx.Lock()
+	defer peer.mx.Unlock()
+	peer.session = session
+	if peer.pc.SignalingState() == webrtc.SignalingStateHaveLocalOffer {
+		err := peer.pc.SetLocalDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeRollback})
+		if err != nil {
+			return err
+		}
+		peer.renegotiate = true
+	}
+	err := peer.pc.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  offer,
+	})
+	if err != nil {
+		return err
+	}
+	for _, candidate := range peer.pending {
+		if err := peer.pc.AddICECandidate(candidate); err != nil {
+			log.Printf("Bot candidate of %s: %s", peer.Name, err)
+		}
+	}
+	peer.pending = nil
+	if hook := peer.bot.hooks.beforeAnswer; hook != nil {
+		hook(peer)
+	}
+	answer, err := peer.pc.CreateAnswer(nil)
+	if err != nil {
+		return err
+	}
+	if err := peer.pc.SetLocalDescription(answer); err != nil {
+		return err
+	}
+	peer.sendEvent(EVENT_ANSWER_CONNECTION, session, BotDescriptionPayload{
+		From: peer.bot.Name,
+		SDP:  *peer.pc.LocalDescription(),
+	})
+	return nil
+}
+
+//accept - applies answer of the client to offer of the bot.
+func (peer *BotPeer) accept(answer string) error {
+	peer.mx.Lock()
+	err := peer.pc.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeAnswer,
+		SDP:  answer,
+	})
+	peer.mx.Unlock()
+	if err != nil {
+		return err
+	}
+	peer.resume()
+	return nil
+}
+
+//Renegotiate - sends new offer to the client after tracks of the bot
+//changed, it's postponed while another negotiation is in progress.
+func (peer *BotPeer) Renegotiate() {
+	peer.mx.Lock()
+	defer peer.mx.Unlock()
+	if peer.pc.SignalingState() != webrtc.SignalingStateStable || peer.pc.RemoteDescription() == nil {
+		peer.renegotiate = true
+		return
+	}
+	peer.renegotiate = false
+	offer, err := peer.pc.CreateOffer(nil)
+	if err == nil {
+		err = peer.pc.SetLocalDescription(offer)
+	}
+	if err != nil {
+		log.Printf("Bot %s renegotiation with %s: %s", peer.bot.Name, peer.Name, err)
+		return
+	}
+	peer.sendEvent(EVENT_OFFER_CONNECTION, peer.session, BotDescriptionPayload{
+		From: peer.bot.Name,
+		SDP:  *peer.pc.LocalDescription(),
+	})
+}
+
+//resume - performs renegotiation postponed during previous one.
+func (peer *BotPeer) resume() {
+	peer.mx.Lock()
+	pending := peer.renegotiate
+	peer.mx.Unlock()
+	if pending {
+		peer.Renegotiate()
+	}
+}
+
+func (peer *BotPeer) addCandidate(candidate webrtc.ICECandidateInit) {
+	peer.mx.Lock()
+	defer peer.mx.Unlock()
+	if peer.pc.RemoteDescription() == nil {
+		peer.pending = append(peer.pending, candidate)
+		return
+	}
+	if err := peer.pc.AddICECandidate(candidate); err != nil {
+		log.Printf("Bot candidate of %s: %s", peer.Name, err)
+	}
+}
+
+func (peer *BotPeer) attach(dc *webrtc.DataChannel) {
+	label := dc.Label()
+	dc.OnOpen(func() {
+		peer.mx.Lock()
+		peer.channels[label] = dc
+		peer.mx.Unlock()
+		log.Printf("Bot data channel %s with %s opened", label, peer.Name)
+	})
+	dc.OnClose(func() {
+		peer.mx.Lock()
+		if peer.channels[label] == dc {
+			delete(peer.channels, label)
+		}
+		peer.mx.Unlock()
+	})
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		if handler := peer.bot.handler(label); handler != nil {
+			handler(peer, label, msg.Data)
+		}
+	})
+}
+
+//Send - writes data to the channel with the label opened by the client.
+func (peer *BotPeer) Send(label string, data []byte) error {
+	peer.mx.Lock()
+	dc := peer.channels[label]
+	peer.mx.Unlock()
+	if dc == nil {
+		return fmt.Errorf("data channel %s with %s is not open", label, peer.Name)
+	}
+	return dc.Send(data)
+}
+
+//Close - closes connection with the client.
+func (peer *BotPeer) Close() {
+	peer.bot.drop(peer.Name)
+}
+
+//sendCandidate - trickles local candidate, waits until the answer
+//is sent so the client never gets candidate before description.
+func (peer *BotPeer) sendCandidate(candidate webrtc.ICECandidateInit) {
+	peer.mx.Lock()
+	session := peer.session
+	peer.mx.Unlock()
+	peer.sendEvent(EVENT_CANDIDATE_CONNECTION, session, BotCandidatePayload{
+		From:      peer.bot.Name,
+		Candidate: candidate,
+	})
+}
+
+func (peer *BotPeer) sendEvent(action string, session string, payload interface{}) {
+	c := peer.bot.cluster.FindClient(peer.Name)
+	if c == nil {
+		return
+	}
+	bts, err := jsoniter.Marshal(payload)
+	if err != nil {
+		log.Println("Bot sendEvent", err)
+		return
+	}
+	raw := jsoniter.RawMessage(bts)
+	bts, err = jsoniter.Marshal(Event{
+		EventHead: &EventHead{
+			Id:      randomId(IdLength),
+			Action:  action,
+			To:      c.Name,
+			Session: session,
+		},
+		Payload: &raw,
+	})
+	if err != nil {
+		log.Println("Bot sendEvent", err)
+		return
+	}
+	c.Send(bts)
+}
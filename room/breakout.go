@@ -0,0 +1,491 @@
+package room
+
+import (
+	"fmt"
+	"github.com/json-iterator/go"
+	"log"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	EVENT_BREAKOUT_OPEN    = "EVENT_BREAKOUT_OPEN"
+	EVENT_BREAKOUT_MESSAGE = "EVENT_BREAKOUT_MESSAGE"
+	EVENT_BREAKOUT_CLOSE   = "EVENT_BREAKOUT_CLOSE"
+	EVENT_BREAKOUT_CLOSING = "EVENT_BREAKOUT_CLOSING"
+	EVENT_BREAKOUT_MOVED   = "EVENT_BREAKOUT_MOVED"
+
+	MaxBreakouts             = 50
+	DefaultBreakoutCountdown = time.Second * 30
+	MaxBreakoutCountdown     = time.Minute * 10
+)
+
+type EventBreakout struct {
+	*EventHead
+	Payload BreakoutPayload `json:"payload"`
+}
+
+type EventBreakoutMessage struct {
+	*EventHead
+	Payload BreakoutMessagePayload `json:"payload"`
+}
+
+type EventBreakoutClosing struct {
+	*EventHead
+	Payload BreakoutClosePayload `json:"payload"`
+}
+
+type EventBreakoutMoved struct {
+	*EventHead
+	Payload BreakoutMovedPayload `json:"payload"`
+}
+
+//BreakoutRoom - child hub with members assigned to it. Empty name is
+//generated from the parent hub id.
+type BreakoutRoom struct {
+	Name    string   `json:"name"`
+	Members []string `json:"members"`
+}
+
+//BreakoutPayload - rooms to open, members of the parent hub which are
+//not assigned manually are spread over the rooms with Random. Missing
+//is set by server to assigned members which left before the move.
+type BreakoutPayload struct {
+	Rooms   []BreakoutRoom `json:"rooms"`
+	Random  bool           `json:"random,omitempty"`
+	Missing []string       `json:"missing,omitempty"`
+}
+
+type BreakoutMessagePayload struct {
+	From string `json:"from,omitempty"`
+	Text string `json:"text"`
+}
+
+//BreakoutClosePayload - Countdown is in seconds, ClosesAt is set by
+//server in EVENT_BREAKOUT_CLOSING.
+type BreakoutClosePayload struct {
+	Countdown int   `json:"countdown,omitempty"`
+	ClosesAt  int64 `json:"closesAt,omitempty"`
+}
+
+type BreakoutMovedPayload struct {
+	Hub    string `json:"hub"`
+	Parent string `json:"parent"`
+}
+
+//breakoutState - child hubs of the parent hub, read by consumers of
+//any client.
+type breakoutState struct {
+	mx      sync.Mutex
+	rooms   []string
+	closing *time.Timer
+}
+
+//open - registers rooms, returns false if breakouts are already open.
+func (b *breakoutState) open(rooms []string) bool {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	if len(b.rooms) > 0 {
+		return false
+	}
+	b.rooms = rooms
+	return true
+}
+
+func (b *breakoutState) list() []string {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	result := make([]string, len(b.rooms))
+	copy(result, b.rooms)
+	return result
+}
+
+//detach - forgets removed child hub.
+func (b *breakoutState) detach(id string) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	for i, room := range b.rooms {
+		if room == id {
+			b.rooms = append(b.rooms[:i:i], b.rooms[i+1:]...)
+			break
+		}
+	}
+	if len(b.rooms) == 0 && b.closing != nil {
+		b.closing.Stop()
+		b.closing = nil
+	}
+}
+
+//schedule - starts countdown, returns false if there is nothing to
+//close or countdown is already running.
+func (b *breakoutState) schedule(countdown time.Duration, close func()) bool {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	if len(b.rooms) == 0 || b.closing != nil {
+		return false
+	}
+	b.closing = time.AfterFunc(countdown, close)
+	return true
+}
+
+//finish - takes rooms to close after countdown.
+func (b *breakoutState) finish() []string {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	rooms := b.rooms
+	b.rooms = nil
+	b.closing = nil
+	return rooms
+}
+
+//HasBreakouts - reports whether hub has open child hubs, such hub is
+//kept while its members are in breakouts.
+func (hub *Hub) HasBreakouts() bool {
+	return len(hub.breakouts.list()) > 0
+}
+
+//assignBreakouts - validates rooms and fills random assignment, error
+//is returned before any hub is created. Names are checked again when
+//the children are registered at once.
+func assignBreakouts(cluster *Cluster, parent *Hub, payload *BreakoutPayload) error {
+	if len(payload.Rooms) == 0 || len(payload.Rooms) > MaxBreakouts {
+		return fmt.Errorf("From 1 to %d breakout rooms are allowed", MaxBreakouts)
+	}
+	members := make(map[string]bool)
+	for _, name := range parent.All() {
+		members[name] = true
+	}
+	assigned := make(map[string]bool)
+	names := make(map[string]bool)
+	for i := range payload.Rooms {
+		room := &payload.Rooms[i]
+		if room.Name == "" {
+			room.Name = parent.ID + "-" + strconv.Itoa(i+1)
+		}
+		if names[room.Name] || cluster.Get(room.Name) != nil || room.Name == cluster.General.ID {
+			return fmt.Errorf("Hub with name %s already exists", room.Name)
+		}
+		names[room.Name] = true
+		for _, name := range room.Members {
+			if !members[name] {
+				return fmt.Errorf("Client %s is not in hub %s", name, parent.ID)
+			}
+			if assigned[name] {
+				return fmt.Errorf("Client %s is assigned twice", name)
+			}
+			assigned[name] = true
+		}
+	}
+	if !payload.Random {
+		return nil
+	}
+	var rest []string
+	for name := range members {
+		if !assigned[name] && !parent.IsOwner(name) {
+			rest = append(rest, name)
+		}
+	}
+	rand.Shuffle(len(rest), func(i, j int) {
+		rest[i], rest[j] = rest[j], rest[i]
+	})
+	for i, name := range rest {
+		room := &payload.Rooms[i%len(payload.Rooms)]
+		room.Members = append(room.Members, name)
+	}
+	return nil
+}
+
+//breakoutMove - moves members of the parent hub to their breakouts as
+//one command of the parent, returns names of members not found in it.
+func (hub *Hub) breakoutMove(moves map[string]*Hub) []string {
+	var missing []string
+	for name, child := range moves {
+		c := hub.pool[name]
+		if c == nil {
+			missing = append(missing, name)
+			continue
+		}
+		hub.removeClient(name, false)
+		child.listener <- commandData{
+			action:   add,
+			client:   c,
+			detached: true,
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+//moveToBreakouts - moves members by name to the child hubs at once.
+func (hub *Hub) moveToBreakouts(moves map[string]*Hub) []string {
+	result := make(chan []string)
+	hub.listener <- commandData{
+		action: breakoutMove,
+		moves:  moves,
+		all:    result,
+	}
+	return <-result
+}
+
+//moveClient - moves client to the hub on behalf of hub owner.
+func moveClient(c *Client, hub *Hub, parent string) {
+	hub.Add(c)
+	announceMove(c, hub, parent)
+}
+
+//announceMove - tells the hub about moved client and the client about
+//its new hub.
+func announceMove(c *Client, hub *Hub, parent string) {
+	emitClientConnected(c, hub)
+	sendRecordingState(c)
+	bts, err := jsoniter.Marshal(EventBreakoutMoved{
+		EventHead: &EventHead{
+			Id:     randomId(IdLength),
+			Action: EVENT_BREAKOUT_MOVED,
+			To:     c.Name,
+		},
+		Payload: BreakoutMovedPayload{
+			Hub:    hub.ID,
+			Parent: parent,
+		},
+	})
+	if err != nil {
+		log.Println("announceMove", err)
+		return
+	}
+	c.Send(bts)
+}
+
+//closeBreakouts - returns members of child hubs to the parent and
+//removes the children. Members are moved first, so the parent isn't
+//removed as empty while there are members to return.
+func closeBreakouts(cluster *Cluster, parent *Hub) {
+	var children []*Hub
+	for _, id := range parent.breakouts.finish() {
+		if child := cluster.Get(id); child != nil {
+			children = append(children, child)
+		}
+	}
+	for _, child := range children {
+		for _, name := range child.All() {
+			if c := child.Get(name); c != nil {
+				moveClient(c, parent, parent.ID)
+			}
+		}
+	}
+	for _, child := range children {
+		cluster.Remove(child.ID)
+		child.Die()
+	}
+	log.Printf("Breakouts of hub %s closed", parent.ID)
+}
+
+//detachBreakout - forgets removed child hub in its parent, the parent
+//is removed too once it has neither breakouts nor members.
+func detachBreakout(cluster *Cluster, hub *Hub) {
+	if hub == nil || hub.Parent == "" {
+		return
+	}
+	parent := cluster.Get(hub.Parent)
+	if parent == nil {
+		return
+	}
+	parent.breakouts.detach(hub.ID)
+	if !parent.HasBreakouts() && parent.Length() == 0 && parent != cluster.General {
+		cluster.Remove(parent.ID)
+		parent.Die()
+	}
+}
+
+//emitBreakouts - sends message to the parent hub and all its breakouts.
+func emitBreakouts(cluster *Cluster, parent *Hub, bts []byte) {
+	parent.Emit(bts)
+	for _, id := range parent.breakouts.list() {
+		cluster.Emit(bts, id)
+	}
+}
+
+func consumeBreakoutOpen(c *Client, event Event) {
+	var payload BreakoutPayload
+	if event.Payload != nil {
+		if err := jsoniter.Unmarshal(*event.Payload, &payload); err != nil {
+			log.Println("consumeBreakoutOpen", err)
+		}
+	}
+	parent := c.Hub
+	cluster := parent.cluster
+	if !parent.IsOwner(c.Name) {
+		notHubOwner(c, parent.ID, event.Id)
+		return
+	}
+	if parent == cluster.General || parent.Parent != "" {
+		sendError(c, event.Id, ERROR_BREAKOUT_STATE, fmt.Sprintf("Hub %s can't have breakouts", parent.ID))
+		return
+	}
+	if err := assignBreakouts(cluster, parent, &payload); err != nil {
+		sendError(c, event.Id, ERROR_BREAKOUT_STATE, err.Error())
+		return
+	}
+	rooms := make([]string, 0, len(payload.Rooms))
+	for _, room := range payload.Rooms {
+		rooms = append(rooms, room.Name)
+	}
+	if !parent.breakouts.open(rooms) {
+		sendError(c, event.Id, ERROR_BREAKOUT_STATE, fmt.Sprintf("Hub %s already has breakouts", parent.ID))
+		return
+	}
+	children := make([]*Hub, 0, len(payload.Rooms))
+	for _, room := range payload.Rooms {
+		child := NewHubWithOptions(room.Name, cluster, HubOptions{
+			Private: parent.Options.Private,
+			Access:  ACCESS_INVITE,
+			Owners:  parent.Options.Owners,
+			SFU:     parent.Options.SFU,
+		})
+		child.Parent = parent.ID
+		children = append(children, child)
+	}
+	if !cluster.AddAll(children) {
+		parent.breakouts.finish()
+		for _, child := range children {
+			child.Die()
+		}
+		sendError(c, event.Id, ERROR_BREAKOUT_STATE, "Breakout hub names are already taken")
+		return
+	}
+	moves := make(map[string]*Hub)
+	for i, room := range payload.Rooms {
+		for _, name := range room.Members {
+			moves[name] = children[i]
+		}
+	}
+	payload.Missing = parent.moveToBreakouts(moves)
+	missing := make(map[string]bool)
+	for _, name := range payload.Missing {
+		missing[name] = true
+	}
+	for i := range payload.Rooms {
+		room := &payload.Rooms[i]
+		members := make([]string, 0, len(room.Members))
+		for _, name := range room.Members {
+			if missing[name] {
+				continue
+			}
+			member := children[i].Get(name)
+			if member == nil {
+				// disconnected right after the move
+				payload.Missing = append(payload.Missing, name)
+				continue
+			}
+			announceMove(member, children[i], parent.ID)
+			members = append(members, name)
+		}
+		room.Members = members
+	}
+	sendBreakouts(c, payload)
+	log.Printf("Client %s opened %d breakouts of hub %s", c.Name, len(children), parent.ID)
+	confirmAction(c, event.Id)
+}
+
+//sendBreakouts - tells the owner which members were moved to which
+//breakout and which of them left before.
+func sendBreakouts(c *Client, payload BreakoutPayload) {
+	bts, err := jsoniter.Marshal(EventBreakout{
+		EventHead: &EventHead{
+			Id:     randomId(IdLength),
+			Action: EVENT_BREAKOUT_OPEN,
+			To:     c.Name,
+		},
+		Payload: payload,
+	})
+	if err != nil {
+		log.Println("sendBreakouts", err)
+		return
+	}
+	c.Send(bts)
+}
+
+func consumeBreakoutMessage(c *Client, event Event) {
+	var payload BreakoutMessagePayload
+	if event.Payload != nil {
+		if err := jsoniter.Unmarshal(*event.Payload, &payload); err != nil {
+			log.Println("consumeBreakoutMessage", err)
+		}
+	}
+	parent := breakoutParent(c)
+	if parent == nil || !parent.IsOwner(c.Name) {
+		notHubOwner(c, c.Hub.ID, event.Id)
+		return
+	}
+	payload.From = c.Name
+	bts, err := jsoniter.Marshal(EventBreakoutMessage{
+		EventHead: &EventHead{
+			Id:     randomId(IdLength),
+			Action: EVENT_BREAKOUT_MESSAGE,
+			To:     TO_EVERYONE,
+		},
+		Payload: payload,
+	})
+	if err != nil {
+		log.Println("consumeBreakoutMessage", err)
+		return
+	}
+	emitBreakouts(parent.cluster, parent, bts)
+	confirmAction(c, event.Id)
+}
+
+func consumeBreakoutClose(c *Client, event Event) {
+	var payload BreakoutClosePayload
+	if event.Payload != nil {
+		if err := jsoniter.Unmarshal(*event.Payload, &payload); err != nil {
+			log.Println("consumeBreakoutClose", err)
+		}
+	}
+	parent := breakoutParent(c)
+	if parent == nil || !parent.IsOwner(c.Name) {
+		notHubOwner(c, c.Hub.ID, event.Id)
+		return
+	}
+	countdown := time.Duration(payload.Countdown) * time.Second
+	if payload.Countdown <= 0 {
+		countdown = DefaultBreakoutCountdown
+	}
+	if countdown > MaxBreakoutCountdown {
+		countdown = MaxBreakoutCountdown
+	}
+	cluster := parent.cluster
+	if !parent.breakouts.schedule(countdown, func() { closeBreakouts(cluster, parent) }) {
+		sendError(c, event.Id, ERROR_BREAKOUT_STATE, fmt.Sprintf("Hub %s has no breakouts to close", parent.ID))
+		return
+	}
+	bts, err := jsoniter.Marshal(EventBreakoutClosing{
+		EventHead: &EventHead{
+			Id:     randomId(IdLength),
+			Action: EVENT_BREAKOUT_CLOSING,
+			To:     TO_EVERYONE,
+		},
+		Payload: BreakoutClosePayload{
+			Countdown: int(countdown / time.Second),
+			ClosesAt:  time.Now().Add(countdown).Unix(),
+		},
+	})
+	if err != nil {
+		log.Println("consumeBreakoutClose", err)
+		return
+	}
+	emitBreakouts(cluster, parent, bts)
+	log.Printf("Client %s closes breakouts of hub %s in %s", c.Name, parent.ID, countdown)
+	confirmAction(c, event.Id)
+}
+
+//breakoutParent - returns hub managing breakouts the client is in, the
+//client may be in the parent or in one of its children.
+func breakoutParent(c *Client) *Hub {
+	if c.Hub.Parent == "" {
+		return c.Hub
+	}
+	return c.Hub.cluster.Get(c.Hub.Parent)
+}
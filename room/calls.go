@@ -0,0 +1,306 @@
+package room
+
+import (
+	"fmt"
+	"github.com/json-iterator/go"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	EVENT_CALL_INVITE  = "EVENT_CALL_INVITE"
+	EVENT_CALL_RINGING = "EVENT_CALL_RINGING"
+	EVENT_CALL_ACCEPT  = "EVENT_CALL_ACCEPT"
+	EVENT_CALL_REJECT  = "EVENT_CALL_REJECT"
+	EVENT_CALL_BUSY    = "EVENT_CALL_BUSY"
+	EVENT_CALL_CANCEL  = "EVENT_CALL_CANCEL"
+	EVENT_CALL_HANGUP  = "EVENT_CALL_HANGUP"
+
+	CALL_RINGING = "ringing"
+	CALL_ACTIVE  = "active"
+	CALL_ENDED   = "ended"
+
+	CALL_REASON_TIMEOUT      = "timeout"
+	CALL_REASON_DISCONNECTED = "disconnected"
+
+	RingTimeout = time.Second * 30
+)
+
+type EventCall struct {
+	*EventHead
+	Payload CallPayload `json:"payload"`
+}
+
+type CallPayload struct {
+	Session  string            `json:"session,omitempty"`
+	Caller   string            `json:"caller,omitempty"`
+	Callee   string            `json:"callee,omitempty"`
+	State    string            `json:"state,omitempty"`
+	Reason   string            `json:"reason,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+//CallSession - call between two clients tracked by the server.
+type CallSession struct {
+	ID        string
+	Caller    string
+	Callee    string
+	State     string
+	CreatedAt time.Time
+	timer     *time.Timer
+}
+
+//Peer - returns the other side of the call for the client name.
+func (s *CallSession) Peer(name string) string {
+	if s.Caller == name {
+		return s.Callee
+	}
+	return s.Caller
+}
+
+func (s *CallSession) payload(reason string) CallPayload {
+	return CallPayload{
+		Session: s.ID,
+		Caller:  s.Caller,
+		Callee:  s.Callee,
+		State:   s.State,
+		Reason:  reason,
+	}
+}
+
+//Calls - registry of call sessions, every client takes part
+//in one call at most.
+type Calls struct {
+	mx       sync.Mutex
+	sessions map[string]*CallSession
+	byClient map[string]*CallSession
+}
+
+func NewCalls() *Calls {
+	return &Calls{
+		sessions: make(map[string]*CallSession),
+		byClient: make(map[string]*CallSession),
+	}
+}
+
+//Get - returns a copy of the session with the id.
+func (calls *Calls) Get(id string) (CallSession, bool) {
+	calls.mx.Lock()
+	defer calls.mx.Unlock()
+	s := calls.sessions[id]
+	if s == nil {
+		return CallSession{}, false
+	}
+	return *s, true
+}
+
+//Between - returns id of the call between two clients, empty if none.
+func (calls *Calls) Between(a, b string) string {
+	calls.mx.Lock()
+	defer calls.mx.Unlock()
+	s := calls.byClient[a]
+	if s == nil || s.Peer(a) != b {
+		return ""
+	}
+	return s.ID
+}
+
+//start - creates ringing session, returns nil session if callee is busy.
+//onTimeout is called when the callee doesn't answer in RingTimeout.
+func (calls *Calls) start(caller, callee string, onTimeout func(CallSession)) (*CallSession, error) {
+	calls.mx.Lock()
+	defer calls.mx.Unlock()
+	if calls.byClient[caller] != nil {
+		return nil, fmt.Errorf("client %s is already in a call", caller)
+	}
+	if calls.byClient[callee] != nil {
+		return nil, nil
+	}
+	s := &CallSession{
+		ID:        randomId(IdLength),
+		Caller:    caller,
+		Callee:    callee,
+		State:     CALL_RINGING,
+		CreatedAt: time.Now(),
+	}
+	id := s.ID
+	s.timer = time.AfterFunc(RingTimeout, func() {
+		if expired, ok := calls.expire(id); ok {
+			onTimeout(expired)
+		}
+	})
+	calls.sessions[s.ID] = s
+	calls.byClient[caller] = s
+	calls.byClient[callee] = s
+	started := *s
+	return &started, nil
+}
+
+//transit - moves session to the next state if client name is allowed
+//to perform the action in the current state.
+func (calls *Calls) transit(id string, name string, action string) (CallSession, error) {
+	calls.mx.Lock()
+	defer calls.mx.Unlock()
+	s := calls.sessions[id]
+	if s == nil || (s.Caller != name && s.Callee != name) {
+		return CallSession{}, fmt.Errorf("call session %s not found", id)
+	}
+	allowed := false
+	switch action {
+	case EVENT_CALL_RINGING:
+		allowed = s.State == CALL_RINGING && s.Callee == name
+	case EVENT_CALL_ACCEPT:
+		allowed = s.State == CALL_RINGING && s.Callee == name
+		if allowed {
+			s.State = CALL_ACTIVE
+			s.timer.Stop()
+		}
+	case EVENT_CALL_REJECT, EVENT_CALL_BUSY:
+		allowed = s.State == CALL_RINGING && s.Callee == name
+	case EVENT_CALL_CANCEL:
+		allowed = s.State == CALL_RINGING && s.Caller == name
+	case EVENT_CALL_HANGUP:
+		allowed = true
+	}
+	if !allowed {
+		return *s, fmt.Errorf("%s is not allowed in call state %s", action, s.State)
+	}
+	switch action {
+	case EVENT_CALL_REJECT, EVENT_CALL_BUSY, EVENT_CALL_CANCEL, EVENT_CALL_HANGUP:
+		calls.end(s)
+	}
+	return *s, nil
+}
+
+//expire - ends session on ring timeout if it's still not answered.
+func (calls *Calls) expire(id string) (CallSession, bool) {
+	calls.mx.Lock()
+	defer calls.mx.Unlock()
+	s := calls.sessions[id]
+	if s == nil || s.State != CALL_RINGING {
+		return CallSession{}, false
+	}
+	calls.end(s)
+	return *s, true
+}
+
+//drop - ends the call of disconnected client.
+func (calls *Calls) drop(name string) (CallSession, bool) {
+	calls.mx.Lock()
+	defer calls.mx.Unlock()
+	s := calls.byClient[name]
+	if s == nil {
+		return CallSession{}, false
+	}
+	calls.end(s)
+	return *s, true
+}
+
+func (calls *Calls) end(s *CallSession) {
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	s.State = CALL_ENDED
+	delete(calls.sessions, s.ID)
+	delete(calls.byClient, s.Caller)
+	delete(calls.byClient, s.Callee)
+}
+
+func consumeCallInvite(c *Client, event Event) {
+	var payload CallPayload
+	if event.Payload != nil {
+		if err := jsoniter.Unmarshal(*event.Payload, &payload); err != nil {
+			log.Println("consumeCallInvite", err)
+		}
+	}
+	cluster := c.Hub.cluster
+	callee := cluster.FindClient(event.To)
+	if callee == nil || callee == c {
+		clientNotFound(c, event.To, event.Id)
+		return
+	}
+	s, err := cluster.calls.start(c.Name, callee.Name, func(expired CallSession) {
+		notifyCallParties(cluster, expired, EVENT_CALL_CANCEL, CALL_REASON_TIMEOUT)
+	})
+	if err != nil {
+		sendError(c, event.Id, ERROR_CALL_STATE, err.Error())
+		return
+	}
+	if s == nil {
+		sendCallEvent(c, event.Id, EVENT_CALL_BUSY, CallPayload{
+			Caller: c.Name,
+			Callee: callee.Name,
+		})
+		return
+	}
+	invite := s.payload("")
+	invite.Metadata = payload.Metadata
+	sendCallEvent(callee, event.Id, EVENT_CALL_INVITE, invite)
+	sendCallEvent(c, event.Id, EVENT_CALL_INVITE, invite)
+}
+
+//consumeCallAction - handles ringing, accept, reject, busy, cancel and
+//hangup actions of a call party and relays them to the other side.
+func consumeCallAction(c *Client, event Event) {
+	var payload CallPayload
+	if event.Payload != nil {
+		if err := jsoniter.Unmarshal(*event.Payload, &payload); err != nil {
+			log.Println("consumeCallAction", err)
+		}
+	}
+	if payload.Session == "" {
+		payload.Session = event.Session
+	}
+	cluster := c.Hub.cluster
+	s, err := cluster.calls.transit(payload.Session, c.Name, event.Action)
+	if err != nil {
+		code := ERROR_CALL_STATE
+		if s.ID == "" {
+			code = ERROR_CALL_NOT_FOUND
+		}
+		sendError(c, event.Id, code, err.Error())
+		return
+	}
+	if peer := cluster.FindClient(s.Peer(c.Name)); peer != nil {
+		p := s.payload(payload.Reason)
+		p.Metadata = payload.Metadata
+		sendCallEvent(peer, event.Id, event.Action, p)
+	}
+	confirmAction(c, event.Id)
+}
+
+//hangupClient - ends the call of the client whose socket died.
+func hangupClient(cluster *Cluster, name string) {
+	if s, ok := cluster.calls.drop(name); ok {
+		if peer := cluster.FindClient(s.Peer(name)); peer != nil {
+			sendCallEvent(peer, randomId(IdLength), EVENT_CALL_HANGUP, s.payload(CALL_REASON_DISCONNECTED))
+		}
+	}
+}
+
+func notifyCallParties(cluster *Cluster, s CallSession, action string, reason string) {
+	id := randomId(IdLength)
+	for _, name := range []string{s.Caller, s.Callee} {
+		if c := cluster.FindClient(name); c != nil {
+			sendCallEvent(c, id, action, s.payload(reason))
+		}
+	}
+}
+
+func sendCallEvent(c *Client, id string, action string, payload CallPayload) {
+	bts, err := jsoniter.Marshal(EventCall{
+		EventHead: &EventHead{
+			Id:      id,
+			Action:  action,
+			To:      c.Name,
+			Session: payload.Session,
+		},
+		Payload: payload,
+	})
+	if err != nil {
+		log.Println("sendCallEvent", err)
+		return
+	}
+	c.Send(bts)
+}
@@ -0,0 +1,131 @@
+package room
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	MaxBufferedCandidates = 64
+	CandidateBufferTTL    = time.Second * 30
+)
+
+//candidateKey - sender, recipient and call session of a negotiation.
+type candidateKey struct {
+	from    string
+	to      string
+	session string
+}
+
+type candidateQueue struct {
+	events []Event
+	timer  *time.Timer
+}
+
+//CandidateBuffer - holds trickled ICE candidates until offer or answer
+//of the sender is delivered to the recipient.
+type CandidateBuffer struct {
+	mx        sync.Mutex
+	queues    map[candidateKey]*candidateQueue
+	delivered map[candidateKey]bool
+}
+
+func NewCandidateBuffer() *CandidateBuffer {
+	return &CandidateBuffer{
+		queues:    make(map[candidateKey]*candidateQueue),
+		delivered: make(map[candidateKey]bool),
+	}
+}
+
+//hold - buffers candidate event if recipient is absent or didn't get
+//description of the sender yet, returns false if it can be relayed.
+//onExpire is called with dropped events when the queue outlives TTL.
+func (b *CandidateBuffer) hold(key candidateKey, present bool, event Event, onExpire func([]Event)) (bool, error) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	if present && b.delivered[key] {
+		return false, nil
+	}
+	queue := b.queues[key]
+	if queue == nil {
+		queue = &candidateQueue{}
+		queue.timer = time.AfterFunc(CandidateBufferTTL, func() {
+			if expired := b.expire(key, queue); len(expired) > 0 {
+				onExpire(expired)
+			}
+		})
+		b.queues[key] = queue
+	}
+	if len(queue.events) >= MaxBufferedCandidates {
+		return true, fmt.Errorf("too many candidates buffered for client %s", key.to)
+	}
+	queue.events = append(queue.events, event)
+	return true, nil
+}
+
+//release - marks description of the sender as delivered, returns
+//buffered candidates in order of their arrival.
+func (b *CandidateBuffer) release(key candidateKey) []Event {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	b.delivered[key] = true
+	queue := b.queues[key]
+	if queue == nil {
+		return nil
+	}
+	queue.timer.Stop()
+	delete(b.queues, key)
+	return queue.events
+}
+
+func (b *CandidateBuffer) expire(key candidateKey, queue *candidateQueue) []Event {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	if b.queues[key] != queue {
+		return nil
+	}
+	delete(b.queues, key)
+	return queue.events
+}
+
+//drop - forgets negotiations of the disconnected client.
+func (b *CandidateBuffer) drop(name string) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	for key, queue := range b.queues {
+		if key.from == name || key.to == name {
+			queue.timer.Stop()
+			delete(b.queues, key)
+		}
+	}
+	for key := range b.delivered {
+		if key.from == name || key.to == name {
+			delete(b.delivered, key)
+		}
+	}
+}
+
+//holdCandidate - buffers candidate relayed from c, returns true if the
+//event is buffered or dropped and must not be relayed now.
+func holdCandidate(c *Client, addressee *Client, event Event) bool {
+	key := candidateKey{from: c.Name, to: event.To, session: event.Session}
+	held, err := c.Hub.cluster.candidates.hold(key, addressee != nil, event, func(expired []Event) {
+		sendError(c, expired[0].Id, ERROR_CANDIDATE_DROPPED,
+			fmt.Sprintf("%d candidates for client %s expired before description was delivered",
+				len(expired), event.To))
+	})
+	if err != nil {
+		sendError(c, event.Id, ERROR_CANDIDATE_DROPPED, err.Error())
+	}
+	return held
+}
+
+//releaseCandidates - relays candidates of c buffered for addressee
+//after description of c was delivered.
+func releaseCandidates(c *Client, addressee *Client, session string) {
+	key := candidateKey{from: c.Name, to: addressee.Name, session: session}
+	for _, event := range c.Hub.cluster.candidates.release(key) {
+		relayEvent(c, addressee, event)
+	}
+}
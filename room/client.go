@@ -7,11 +7,15 @@ import (
 
 type Client struct {
 	send        chan<- []byte
+	binary      chan<- []byte
 	read        <-chan []byte
 	Name        string
 	die         <-chan struct{}
 	Hub         *Hub
 	hubListener chan<- commandData
+	//session - secret of the connection, lets the client refresh ICE
+	//servers over HTTP.
+	session string
 }
 
 func NewClient(send chan<- []byte, read <-chan []byte, die <-chan struct{}, name string) *Client {
@@ -20,14 +24,18 @@ func NewClient(send chan<- []byte, read <-chan []byte, die <-chan struct{}, name
 		read: read,
 		Name: name,
 		die:  die,
+
+		session: secureToken(SessionTokenLength),
 	}
 	log.Println("Client " + c.Name + " connected...")
 	go c.watch()
 	return c
 }
 
-func (c *Client) attachToHub(hub *Hub) {
-	if c.Hub != nil {
+//attachToHub - makes the hub current one, detached is set if the
+//previous hub has already removed the client itself.
+func (c *Client) attachToHub(hub *Hub, detached bool) {
+	if c.Hub != nil && !detached {
 		c.hubListener <- commandData{
 			action: remove,
 			key:    c.Name,
@@ -58,12 +66,35 @@ func (c *Client) Send(msg []byte) {
 	c.send <- msg
 }
 
+//UseBinary - sets channel of binary frames written to the websocket.
+func (c *Client) UseBinary(binary chan<- []byte) {
+	c.binary = binary
+}
+
+//SendBinary - writes binary frame without blocking, returns false if
+//the client can't receive binary frames or its buffer is full.
+func (c *Client) SendBinary(msg []byte) bool {
+	if c.binary == nil {
+		return false
+	}
+	select {
+	case c.binary <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
 func (c *Client) Die() {
 	log.Println("Client " + c.Name + " disconnected...")
 	if c.hubListener != nil {
 		c.hubListener <- commandData{
-			action: remove,
-			key:    c.Name,
+			action:       remove,
+			key:          c.Name,
+			disconnected: true,
 		}
 	}
+	if c.Hub != nil {
+		go c.Hub.cluster.releaseClient(c.Name)
+	}
 }
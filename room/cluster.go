@@ -1,8 +1,11 @@
 package room
 
 import (
+	"crypto/subtle"
 	"os"
 	"os/signal"
+	"sort"
+	"sync"
 	"time"
 )
 
@@ -11,8 +14,11 @@ type commandPayload struct {
 	id     string
 	result chan<- *Hub
 	all    chan<- []string
+	hubs   chan<- []*Hub
 	data   []byte
 	hub    *Hub
+	batch  []*Hub
+	ok     chan<- bool
 }
 
 type Cluster struct {
@@ -20,13 +26,40 @@ type Cluster struct {
 	General  *Hub
 	listener chan commandPayload
 	pool     map[string]*Hub
+	calls    *Calls
+	clients  *clientIndex
+
+	negotiations *Negotiations
+	sdp          *SDPLog
+	policies     *Policies
+	candidates   *CandidateBuffer
+	ice          *ICE
+	relays       *Relays
+	stats        *Stats
+	graphs       *Graphs
+	bots         map[string]*Bot
+	recorder     *Recorder
+	sfu          *Bot
+	onRelease    []func(name string)
 }
 
 func NewCluster() *Cluster {
 	cluster := Cluster{
 		listener: make(chan commandPayload),
 		pool:     make(map[string]*Hub),
+		calls:    NewCalls(),
+		clients:  &clientIndex{clients: make(map[string]indexEntry)},
 		General:  nil,
+
+		negotiations: NewNegotiations(),
+		sdp:          NewSDPLog(),
+		policies:     NewPolicies(),
+		candidates:   NewCandidateBuffer(),
+		ice:          NewICE(),
+		relays:       NewRelays(),
+		stats:        NewStats(),
+		graphs:       NewGraphs(),
+		bots:         make(map[string]*Bot),
 	}
 	cluster.General = NewHub("general", &cluster)
 	go cluster.run()
@@ -45,6 +78,8 @@ func (cluster *Cluster) run() {
 		switch command.action {
 		case add:
 			cluster.pool[command.hub.ID] = command.hub
+		case addAll:
+			command.ok <- cluster.addAll(command.batch)
 		case get:
 			command.result <- cluster.pool[command.id]
 		case remove:
@@ -64,6 +99,12 @@ func (cluster *Cluster) run() {
 				result = append(result, hub.ID)
 			}
 			command.all <- result
+		case list:
+			result := make([]*Hub, 0, len(cluster.pool))
+			for _, hub := range cluster.pool {
+				result = append(result, hub)
+			}
+			command.hubs <- result
 		}
 	}
 }
@@ -77,6 +118,249 @@ func (cluster *Cluster) All() []string {
 	return <-result
 }
 
+//Hubs - returns all hubs registered in the cluster.
+func (cluster *Cluster) Hubs() []*Hub {
+	result := make(chan []*Hub)
+	cluster.listener <- commandPayload{
+		action: list,
+		hubs:   result,
+	}
+	return <-result
+}
+
+//clientIndex - connected clients by name with hubs they are in, updated
+//by hubs on add and remove so lookups don't have to ask every hub.
+type clientIndex struct {
+	mx      sync.Mutex
+	clients map[string]indexEntry
+}
+
+type indexEntry struct {
+	client *Client
+	hub    *Hub
+}
+
+func (i *clientIndex) set(c *Client, hub *Hub) {
+	i.mx.Lock()
+	defer i.mx.Unlock()
+	i.clients[c.Name] = indexEntry{client: c, hub: hub}
+}
+
+//drop - forgets the client removed from the hub. Entry added by another
+//hub is kept, the client was moved there or reconnected.
+func (i *clientIndex) drop(c *Client, hub *Hub) {
+	if c == nil {
+		return
+	}
+	i.mx.Lock()
+	defer i.mx.Unlock()
+	if entry := i.clients[c.Name]; entry.client == c && entry.hub == hub {
+		delete(i.clients, c.Name)
+	}
+}
+
+func (i *clientIndex) get(name string) *Client {
+	i.mx.Lock()
+	defer i.mx.Unlock()
+	return i.clients[name].client
+}
+
+//FindClient - looks for connected client with the name in any hub of
+//the cluster.
+func (cluster *Cluster) FindClient(name string) *Client {
+	return cluster.clients.get(name)
+}
+
+//Negotiations - returns state of all tracked peer negotiations.
+func (cluster *Cluster) Negotiations() []NegotiationInfo {
+	return cluster.negotiations.All()
+}
+
+//UseSDPInspector - registers inspector of every relayed offer and answer.
+func (cluster *Cluster) UseSDPInspector(inspector SDPInspector) {
+	cluster.sdp.Use(inspector)
+}
+
+//SetSDPValidation - sets validation level of hubs which don't choose
+//their own, permissive by default.
+func (cluster *Cluster) SetSDPValidation(level string) error {
+	return cluster.sdp.SetValidation(level)
+}
+
+//SDPRecords - returns summaries of the last relayed session descriptions.
+func (cluster *Cluster) SDPRecords() []SDPRecord {
+	return cluster.sdp.All()
+}
+
+//SetPolicies - replaces media policies enforced on relayed events.
+func (cluster *Cluster) SetPolicies(config PolicyConfig) {
+	cluster.policies.Set(config)
+}
+
+//PolicyAudit - returns recent events rewritten or dropped by policies.
+func (cluster *Cluster) PolicyAudit() []PolicyAuditRecord {
+	return cluster.policies.Audit()
+}
+
+//Quality - returns connection quality reported by clients per hub.
+func (cluster *Cluster) Quality() []HubQuality {
+	return cluster.stats.All()
+}
+
+//QualitySamples - returns the last raw stats samples of the hub.
+func (cluster *Cluster) QualitySamples(hubID string) []StatsSample {
+	return cluster.stats.Samples(hubID)
+}
+
+//Graph - returns peer connection graph of the hub, of every hub with
+//reported connections if id is empty.
+func (cluster *Cluster) Graph(hubID string) []HubGraph {
+	ids := []string{hubID}
+	if hubID == "" {
+		ids = cluster.graphs.hubs()
+		sort.Strings(ids)
+	}
+	result := make([]HubGraph, 0, len(ids))
+	for _, id := range ids {
+		var members []string
+		hub := cluster.General
+		if id != hub.ID {
+			hub = cluster.Get(id)
+		}
+		if hub != nil {
+			members = hub.All()
+		}
+		result = append(result, cluster.graphs.graph(id, members))
+	}
+	return result
+}
+
+//SetICEConfig - replaces STUN and TURN servers distributed to clients.
+func (cluster *Cluster) SetICEConfig(config ICEConfig) {
+	cluster.ice.Set(config)
+}
+
+//ICEServers - returns ICE servers with fresh TURN credentials for name.
+func (cluster *Cluster) ICEServers(name string) ICEServersPayload {
+	servers, ttl := cluster.ice.Servers(name)
+	return ICEServersPayload{
+		ICEServers: servers,
+		TTL:        int(ttl / time.Second),
+	}
+}
+
+//SessionICEServers - returns ICE servers for connected client which
+//presented token of its websocket session.
+func (cluster *Cluster) SessionICEServers(name string, token string) (ICEServersPayload, bool) {
+	c := cluster.FindClient(name)
+	if c == nil || token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(c.session)) != 1 {
+		return ICEServersPayload{}, false
+	}
+	return cluster.ICEServers(name), true
+}
+
+//AdvertiseSTUN - adds STUN server to ICE servers sent to clients.
+func (cluster *Cluster) AdvertiseSTUN(url string) {
+	cluster.ice.AddSTUN(url)
+}
+
+//AdvertiseTURN - adds TURN server to ICE servers sent to clients.
+func (cluster *Cluster) AdvertiseTURN(url string) {
+	cluster.ice.AddTURN(url)
+}
+
+//SetRelayConfig - replaces limits of streams relayed via websocket.
+func (cluster *Cluster) SetRelayConfig(config RelayConfig) {
+	cluster.relays.Set(config)
+}
+
+//EnableBot - makes the cluster answer offers sent to the name with
+//server side peer connection, must be used before serving clients.
+func (cluster *Cluster) EnableBot(name string) *Bot {
+	bot := NewBot(name, cluster)
+	cluster.bots[bot.Name] = bot
+	return bot
+}
+
+//EnableEcho - adds diagnostic peer echoing media and data back to
+//clients, must be used before serving clients.
+func (cluster *Cluster) EnableEcho(name string) (*Bot, error) {
+	bot, err := NewEchoBot(name, cluster)
+	if err != nil {
+		return nil, err
+	}
+	cluster.bots[bot.Name] = bot
+	return bot, nil
+}
+
+//EnableSFU - adds selective forwarding unit used by clients of hubs
+//in SFU mode, must be used before serving clients.
+func (cluster *Cluster) EnableSFU(name string) (*Bot, error) {
+	bot, err := NewSFU(name, cluster)
+	if err != nil {
+		return nil, err
+	}
+	cluster.bots[bot.Name] = bot
+	cluster.sfu = bot
+	return bot, nil
+}
+
+//EnableRecorder - allows owners to record hubs to the directory, must
+//be used before serving clients.
+func (cluster *Cluster) EnableRecorder(name string, dir string) (*Recorder, error) {
+	recorder, err := NewRecorder(name, dir, cluster)
+	if err != nil {
+		return nil, err
+	}
+	cluster.bots[recorder.bot.Name] = recorder.bot
+	cluster.recorder = recorder
+	return recorder, nil
+}
+
+//PushRecordingState - tells just connected client that its hub is
+//being recorded.
+func (cluster *Cluster) PushRecordingState(c *Client) {
+	sendRecordingState(c)
+}
+
+//Bot - returns server side peer with the name, nil if it's not enabled.
+func (cluster *Cluster) Bot(name string) *Bot {
+	return cluster.bots[name]
+}
+
+//IsReserved - reports whether clients can't connect with the name.
+func (cluster *Cluster) IsReserved(name string) bool {
+	return cluster.bots[name] != nil
+}
+
+//PushICEServers - sends ICE servers to just connected client.
+func (cluster *Cluster) PushICEServers(c *Client) {
+	sendICEServers(cluster, c, randomId(IdLength))
+}
+
+//releaseClient - cleans up cluster wide state of disconnected client.
+func (cluster *Cluster) releaseClient(name string) {
+	hangupClient(cluster, name)
+	cluster.negotiations.drop(name)
+	cluster.sdp.drop(name)
+	cluster.candidates.drop(name)
+	dropRelays(cluster, name)
+	cluster.stats.drop(name)
+	cluster.graphs.drop(name)
+	for _, bot := range cluster.bots {
+		bot.drop(name)
+	}
+	for _, fn := range cluster.onRelease {
+		fn(name)
+	}
+}
+
+//OnClientRelease - registers function called when client disconnects,
+//must be used before the cluster starts serving clients.
+func (cluster *Cluster) OnClientRelease(fn func(name string)) {
+	cluster.onRelease = append(cluster.onRelease, fn)
+}
+
 func (cluster *Cluster) Add(hub *Hub) {
 	cluster.listener <- commandPayload{
 		action: add,
@@ -84,6 +368,31 @@ func (cluster *Cluster) Add(hub *Hub) {
 	}
 }
 
+//AddAll - registers all hubs or none of them if any name is taken.
+func (cluster *Cluster) AddAll(hubs []*Hub) bool {
+	ok := make(chan bool)
+	cluster.listener <- commandPayload{
+		action: addAll,
+		batch:  hubs,
+		ok:     ok,
+	}
+	return <-ok
+}
+
+func (cluster *Cluster) addAll(hubs []*Hub) bool {
+	names := make(map[string]bool)
+	for _, hub := range hubs {
+		if names[hub.ID] || cluster.pool[hub.ID] != nil || hub.ID == cluster.General.ID {
+			return false
+		}
+		names[hub.ID] = true
+	}
+	for _, hub := range hubs {
+		cluster.pool[hub.ID] = hub
+	}
+	return true
+}
+
 func (cluster *Cluster) Get(id string) *Hub {
 	result := make(chan *Hub)
 	cluster.listener <- commandPayload{
@@ -95,10 +404,16 @@ func (cluster *Cluster) Get(id string) *Hub {
 }
 
 func (cluster *Cluster) Remove(id string) {
+	detachBreakout(cluster, cluster.Get(id))
 	cluster.listener <- commandPayload{
 		action: remove,
 		id:     id,
 	}
+	cluster.stats.dropHub(id)
+	cluster.graphs.dropHub(id)
+	if cluster.recorder != nil {
+		cluster.recorder.stop(id)
+	}
 	consumeHubRemoved(cluster, EventHubRemoved{
 		EventHead: &EventHead{
 			Action: EVENT_HUB_REMOVED,
@@ -0,0 +1,209 @@
+package room
+
+import (
+	"github.com/pion/webrtc/v4"
+	"log"
+	"strings"
+	"time"
+)
+
+const (
+	EVENT_DIAGNOSTICS = "EVENT_DIAGNOSTICS"
+
+	DefaultEchoName     = "echo"
+	DiagnosticsInterval = time.Second * 2
+)
+
+//DiagnosticsPayload - connection quality observed by the echo peer.
+type DiagnosticsPayload struct {
+	From  string `json:"from"`
+	State string `json:"state"`
+	//RTT - round trip time of the selected candidate pair in seconds.
+	RTT             float64           `json:"rtt"`
+	LocalCandidate  *CandidateSummary `json:"localCandidate,omitempty"`
+	RemoteCandidate *CandidateSummary `json:"remoteCandidate,omitempty"`
+	BytesSent       uint64            `json:"bytesSent"`
+	BytesReceived   uint64            `json:"bytesReceived"`
+	Streams         []StreamSummary   `json:"streams"`
+}
+
+//CandidateSummary - one side of the selected candidate pair.
+type CandidateSummary struct {
+	Type     string `json:"type"`
+	Protocol string `json:"protocol"`
+	Address  string `json:"address"`
+	Port     int    `json:"port"`
+}
+
+//StreamSummary - reception of single incoming RTP stream.
+type StreamSummary struct {
+	Kind            string  `json:"kind"`
+	Mid             string  `json:"mid,omitempty"`
+	PacketsReceived uint32  `json:"packetsReceived"`
+	PacketsLost     int32   `json:"packetsLost"`
+	Loss            float64 `json:"loss"`
+	Jitter          float64 `json:"jitter"`
+}
+
+//NewEchoBot - creates diagnostic peer which sends received audio, video
+//and data channel messages back and reports connection quality.
+func NewEchoBot(name string, cluster *Cluster) (*Bot, error) {
+	if name == "" {
+		name = DefaultEchoName
+	}
+	api, err := newMediaAPI()
+	if err != nil {
+		return nil, err
+	}
+	bot := NewBot(name, cluster)
+	bot.api = api
+	bot.hooks = botHooks{
+		beforeAnswer: (*BotPeer).addEchoTracks,
+		track:        (*BotPeer).reflect,
+		connected:    (*BotPeer).report,
+	}
+	bot.Handle("", func(peer *BotPeer, label string, data []byte) {
+		if err := peer.Send(label, data); err != nil {
+			log.Printf("Echo to %s: %s", peer.Name, err)
+		}
+	})
+	return bot, nil
+}
+
+//addEchoTracks - adds outgoing track for every offered audio and video
+//section, so the answer sends media back.
+func (peer *BotPeer) addEchoTracks() {
+	offer := peer.pc.RemoteDescription()
+	if offer == nil {
+		return
+	}
+	_, summary, err := ParseSDP(offer.SDP)
+	if err != nil {
+		return
+	}
+	for _, m := range summary.Media {
+		if (m.Kind != "audio" && m.Kind != "video") || m.Port == 0 || len(m.Codecs) == 0 {
+			continue
+		}
+		codec := strings.SplitN(m.Codecs[0], "/", 2)[0]
+		track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{
+			MimeType: m.Kind + "/" + codec,
+		}, "echo-"+m.Mid, peer.bot.Name)
+		if err != nil {
+			log.Printf("Echo track for %s: %s", peer.Name, err)
+			continue
+		}
+		sender, err := peer.pc.AddTrack(track)
+		if err != nil {
+			log.Printf("Echo track for %s: %s", peer.Name, err)
+			continue
+		}
+		go drainRTCP(sender)
+	}
+}
+
+//drainRTCP - reads RTCP of the sender so interceptors can process it.
+func drainRTCP(sender *webrtc.RTPSender) {
+	buf := make([]byte, 1500)
+	for {
+		if _, _, err := sender.Read(buf); err != nil {
+			return
+		}
+	}
+}
+
+//reflect - writes packets of the incoming track to outgoing track of
+//the same transceiver.
+func (peer *BotPeer) reflect(remote *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+	var local *webrtc.TrackLocalStaticRTP
+	for _, t := range peer.pc.GetTransceivers() {
+		if t.Receiver() == receiver && t.Sender() != nil {
+			local, _ = t.Sender().Track().(*webrtc.TrackLocalStaticRTP)
+		}
+	}
+	if local == nil || !strings.EqualFold(local.Codec().MimeType, remote.Codec().MimeType) {
+		log.Printf("Echo can't reflect %s track of %s", remote.Codec().MimeType, peer.Name)
+		return
+	}
+	for {
+		packet, _, err := remote.ReadRTP()
+		if err != nil {
+			return
+		}
+		if err := local.WriteRTP(packet); err != nil {
+			return
+		}
+	}
+}
+
+//report - periodically sends diagnostics to the client while the
+//connection is alive.
+func (peer *BotPeer) report() {
+	peer.mx.Lock()
+	if peer.reporting {
+		peer.mx.Unlock()
+		return
+	}
+	peer.reporting = true
+	peer.mx.Unlock()
+	ticker := time.NewTicker(DiagnosticsInterval)
+	defer ticker.Stop()
+	for {
+		if peer.bot.Peer(peer.Name) != peer {
+			return
+		}
+		peer.mx.Lock()
+		session := peer.session
+		peer.mx.Unlock()
+		peer.sendEvent(EVENT_DIAGNOSTICS, session, peer.diagnostics())
+		<-ticker.C
+	}
+}
+
+func (peer *BotPeer) diagnostics() DiagnosticsPayload {
+	payload := DiagnosticsPayload{
+		From:    peer.bot.Name,
+		State:   peer.pc.ConnectionState().String(),
+		Streams: []StreamSummary{},
+	}
+	report := peer.pc.GetStats()
+	for _, s := range report {
+		switch stats := s.(type) {
+		case webrtc.ICECandidatePairStats:
+			if !stats.Nominated || stats.State != webrtc.StatsICECandidatePairStateSucceeded {
+				continue
+			}
+			payload.RTT = stats.CurrentRoundTripTime
+			payload.BytesSent = stats.BytesSent
+			payload.BytesReceived = stats.BytesReceived
+			payload.LocalCandidate = candidateSummary(report, stats.LocalCandidateID)
+			payload.RemoteCandidate = candidateSummary(report, stats.RemoteCandidateID)
+		case webrtc.InboundRTPStreamStats:
+			stream := StreamSummary{
+				Kind:            stats.Kind,
+				Mid:             stats.Mid,
+				PacketsReceived: stats.PacketsReceived,
+				PacketsLost:     stats.PacketsLost,
+				Jitter:          stats.Jitter,
+			}
+			if total := float64(stats.PacketsReceived) + float64(stats.PacketsLost); total > 0 {
+				stream.Loss = float64(stats.PacketsLost) / total
+			}
+			payload.Streams = append(payload.Streams, stream)
+		}
+	}
+	return payload
+}
+
+func candidateSummary(report webrtc.StatsReport, id string) *CandidateSummary {
+	stats, ok := report[id].(webrtc.ICECandidateStats)
+	if !ok {
+		return nil
+	}
+	return &CandidateSummary{
+		Type:     stats.CandidateType.String(),
+		Protocol: stats.Protocol,
+		Address:  stats.IP,
+		Port:     int(stats.Port),
+	}
+}
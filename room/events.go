@@ -19,6 +19,7 @@ const (
 	EVENT_CLIENT_REMOVED   = "EVENT_CLIENT_REMOVED"
 	EVENT_GET_CLIENTS      = "EVENT_GET_CLIENTS"
 	EVENT_GET_HUBS         = "EVENT_GET_HUBS"
+	EVENT_NEW_INVITE_TOKEN = "EVENT_NEW_INVITE_TOKEN"
 
 	EVENT_OFFER_CONNECTION     = "EVENT_OFFER_CONNECTION"
 	EVENT_ANSWER_CONNECTION    = "EVENT_ANSWER_CONNECTION"
@@ -34,6 +35,35 @@ const (
 	ReplyTimeout = time.Second * 5
 )
 
+const (
+	ERROR_CLIENT_NOT_FOUND = 1000 + iota
+	ERROR_CLIENT_TIMEOUT
+	ERROR_CLIENT_NOT_WAITING
+	ERROR_HUB_NOT_FOUND
+	ERROR_HUB_EXISTS
+	ERROR_HUB_FULL
+	ERROR_ACCESS_DENIED
+	ERROR_NOT_OWNER
+	ERROR_JOIN_DENIED
+	ERROR_JOIN_TIMEOUT
+	ERROR_CALL_NOT_FOUND
+	ERROR_CALL_STATE
+	ERROR_INVALID_SDP
+	ERROR_CANDIDATE_DROPPED
+	ERROR_RELAY_NOT_FOUND
+	ERROR_RELAY_LIMIT
+	ERROR_BOT_FAILED
+	ERROR_RECORDING_STATE
+	ERROR_CONSENT_REQUIRED
+	ERROR_INVALID_TRACK
+	ERROR_INVALID_PEER_STATE
+	ERROR_NOT_PUBLISHER
+	ERROR_BREAKOUT_STATE
+	ERROR_INVALID_OPTIONS
+	ERROR_INVALID_STATS
+	ERROR_NOT_MESH
+)
+
 var letterRunes = []rune("0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
 var eventsKeyQueue = NewKeyQueue()
 
@@ -50,9 +80,10 @@ func randomId(n int) string {
 }
 
 type EventHead struct {
-	Id     string `json:"id"`
-	Action string `json:"action"`
-	To     string `json:"to,omitempty"`
+	Id      string `json:"id"`
+	Action  string `json:"action"`
+	To      string `json:"to,omitempty"`
+	Session string `json:"session,omitempty"`
 }
 
 type Event struct {
@@ -105,7 +136,13 @@ type EventGetClients struct {
 	Payload GetClientsPayload `json:"payload"`
 }
 
+type EventInviteToken struct {
+	*EventHead
+	Payload InviteTokenPayload `json:"payload"`
+}
+
 type ErrorPayload struct {
+	Code int    `json:"code,omitempty"`
 	Info string `json:"info"`
 }
 
@@ -118,15 +155,27 @@ type HubRemovedPayload struct {
 }
 
 type HubConnectPayload struct {
-	Name string `json:"name"`
+	Name     string            `json:"name"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Credentials
+}
+
+type InviteTokenPayload struct {
+	Name      string `json:"name"`
+	TTL       int    `json:"ttl,omitempty"`
+	MaxUses   int    `json:"maxUses,omitempty"`
+	Token     string `json:"token,omitempty"`
+	ExpiresAt int64  `json:"expiresAt,omitempty"`
 }
 
 type GetClientsPayload struct {
-	Clients []string `json:"clients"`
+	Clients []string                `json:"clients"`
+	Media   map[string][]MediaTrack `json:"media,omitempty"`
 }
 
 type NewHubPayload struct {
 	Name string `json:"name"`
+	HubOptions
 }
 
 type ClientRemovedPayload struct {
@@ -138,7 +187,8 @@ type ClientConnectPayload struct {
 }
 
 type AllPayload struct {
-	Hubs []string `json:"hubs"`
+	Hubs   []HubInfo `json:"hubs"`
+	Cursor string    `json:"cursor,omitempty"`
 }
 
 type HubClientPayload struct {
@@ -161,6 +211,65 @@ func ConsumeEvent(c *Client, event Event) {
 		consumeHubConnectEvent(c, event)
 	case EVENT_GET_CLIENTS:
 		consumeGetClients(c, event)
+	case EVENT_NEW_INVITE_TOKEN:
+		consumeNewInviteToken(c, event)
+	case EVENT_JOIN_RESPONSE:
+		consumeJoinResponse(c, event)
+	case EVENT_HUB_INVITE:
+		consumeHubInvite(c, event)
+	case EVENT_HUB_INVITE_RESPONSE:
+		consumeHubInviteResponse(c, event)
+	case EVENT_ICE_SERVERS:
+		consumeGetICEServers(c, event)
+	case EVENT_MESH_CONNECTED:
+		consumeMeshConnected(c, event)
+	case EVENT_CALL_INVITE:
+		consumeCallInvite(c, event)
+	case EVENT_CALL_RINGING, EVENT_CALL_ACCEPT, EVENT_CALL_REJECT,
+		EVENT_CALL_BUSY, EVENT_CALL_CANCEL, EVENT_CALL_HANGUP:
+		consumeCallAction(c, event)
+	case EVENT_RELAY_OPEN:
+		consumeRelayOpen(c, event)
+	case EVENT_RELAY_DATA:
+		consumeRelayData(c, event)
+	case EVENT_RELAY_CLOSE:
+		consumeRelayClose(c, event)
+	case EVENT_RECORDING_START:
+		consumeRecordingStart(c, event)
+	case EVENT_RECORDING_STOP:
+		consumeRecordingStop(c, event)
+	case EVENT_RECORDING_CONSENT:
+		consumeRecordingConsent(c, event)
+	case EVENT_HAND_RAISE:
+		consumeHandRaise(c, event)
+	case EVENT_HAND_LOWER:
+		consumeHandLower(c, event)
+	case EVENT_FLOOR_GRANT:
+		consumeFloorGrant(c, event)
+	case EVENT_BREAKOUT_OPEN:
+		consumeBreakoutOpen(c, event)
+	case EVENT_BREAKOUT_MESSAGE:
+		consumeBreakoutMessage(c, event)
+	case EVENT_BREAKOUT_CLOSE:
+		consumeBreakoutClose(c, event)
+	case EVENT_STAGE_PROMOTE:
+		consumeStagePromote(c, event)
+	case EVENT_STAGE_DEMOTE:
+		consumeStageDemote(c, event)
+	case EVENT_AUDIO_LEVEL:
+		consumeAudioLevel(c, event)
+	case EVENT_SPOTLIGHT:
+		consumeSpotlight(c, event)
+	case EVENT_PEER_STATE:
+		consumePeerState(c, event)
+	case EVENT_STATS_REPORT:
+		consumeStatsReport(c, event)
+	case EVENT_MEDIA_TRACK:
+		consumeMediaTrack(c, event)
+	case EVENT_MEDIA_TRACK_REMOVED:
+		consumeMediaTrackRemoved(c, event)
+	case EVENT_MUTE_REQUEST:
+		consumeMuteRequest(c, event)
 	case EVENT_CLIENT_REPLY_REQUEST:
 		consumeClientReplyRequest(c, event)
 	case EVENT_CLIENT_REPLY_RESPONSE:
@@ -177,10 +286,27 @@ func consumeNewHubEvent(c *Client, event Event) {
 		hubAlreadyExist(c, payload.Name, event.Id)
 		return
 	}
-	newHub := NewHub(payload.Name, c.Hub.cluster)
+	if err := payload.HubOptions.ValidateAccess(); err != nil {
+		sendError(c, event.Id, ERROR_INVALID_OPTIONS, err.Error())
+		return
+	}
+	if err := payload.HubOptions.ValidateSDP(); err != nil {
+		sendError(c, event.Id, ERROR_INVALID_OPTIONS, err.Error())
+		return
+	}
+	if payload.SFU && c.Hub.cluster.sfu == nil {
+		sendError(c, event.Id, ERROR_INVALID_OPTIONS, "SFU is disabled")
+		return
+	}
+	if !containsString(payload.Owners, c.Name) {
+		payload.Owners = append(payload.Owners, c.Name)
+	}
+	newHub := NewHubWithOptions(payload.Name, c.Hub.cluster, payload.HubOptions)
 	c.Hub.cluster.Add(newHub)
 	newHub.Add(c)
-	emitNewHubCreated(c, newHub.ID)
+	if !newHub.Options.Private {
+		emitNewHubCreated(c, newHub.ID)
+	}
 	confirmAction(c, event.Id)
 }
 
@@ -194,26 +320,140 @@ func consumeHubConnectEvent(c *Client, event Event) {
 		hubNotFound(c, payload.Name, event.Id)
 		return
 	}
+	if err := hub.Authorize(c.Name, payload.Credentials); err != nil {
+		if hub.Options.Lobby {
+			knockHub(c, hub, payload.Metadata, event.Id)
+			return
+		}
+		accessDenied(c, payload.Name, err, event.Id)
+		return
+	}
+	if !hub.HasSpace() {
+		hubIsFull(c, payload.Name, event.Id)
+		return
+	}
+	if err := hub.Admit(c.Name, payload.Credentials); err != nil {
+		accessDenied(c, payload.Name, err, event.Id)
+		return
+	}
+	joinHub(c, hub, event.Id)
+}
+
+//joinHub - moves already authorized client into the hub.
+func joinHub(c *Client, hub *Hub, id string) {
 	hub.Add(c)
 	emitClientConnected(c, hub)
-	confirmAction(c, event.Id)
+	confirmAction(c, id)
+	sendRecordingState(c)
+}
+
+func consumeNewInviteToken(c *Client, event Event) {
+	var payload InviteTokenPayload
+	if event.Payload != nil {
+		if err := jsoniter.Unmarshal(*event.Payload, &payload); err != nil {
+			log.Println("consumeNewInviteToken", err)
+		}
+	}
+	hub := c.Hub.cluster.Get(payload.Name)
+	if hub == nil {
+		hubNotFound(c, payload.Name, event.Id)
+		return
+	}
+	if !hub.IsOwner(c.Name) {
+		notHubOwner(c, payload.Name, event.Id)
+		return
+	}
+	ttl := DefaultInviteTTL
+	if payload.TTL > 0 {
+		ttl = time.Duration(payload.TTL) * time.Second
+	}
+	if ttl > MaxInviteTTL {
+		ttl = MaxInviteTTL
+	}
+	token, expiresAt := hub.invites.Mint(ttl, payload.MaxUses)
+	bts, err := jsoniter.Marshal(EventInviteToken{
+		EventHead: &EventHead{
+			Id:     event.Id,
+			Action: EVENT_NEW_INVITE_TOKEN,
+			To:     c.Name,
+		},
+		Payload: InviteTokenPayload{
+			Name:      hub.ID,
+			TTL:       int(ttl / time.Second),
+			MaxUses:   payload.MaxUses,
+			Token:     token,
+			ExpiresAt: expiresAt.Unix(),
+		},
+	})
+	if err != nil {
+		log.Println("consumeNewInviteToken", err)
+		return
+	}
+	c.Send(bts)
 }
 
 func consumeDirectRawEvent(c *Client, event Event) {
+	if !stageAllows(c, event) {
+		return
+	}
+	if bot := c.Hub.cluster.bots[event.To]; bot != nil {
+		bot.consume(c, event)
+		return
+	}
+	calls := c.Hub.cluster.calls
+	session := calls.Between(c.Name, event.To)
+	if event.Session != "" && event.Session != session {
+		sendError(c, event.Id, ERROR_CALL_NOT_FOUND,
+			fmt.Sprintf("Call session %s with client %s not found", event.Session, event.To))
+		return
+	}
+	event.Session = session
 	addressee := c.Hub.Get(event.To)
+	if addressee == nil && session != "" {
+		// parties of a call may stay in different hubs
+		addressee = c.Hub.cluster.FindClient(event.To)
+	}
+	if event.Action == EVENT_CANDIDATE_CONNECTION && holdCandidate(c, addressee, event) {
+		return
+	}
 	if addressee == nil {
 		clientNotFound(c, event.To, event.Id)
 		return
 	}
+	relayEvent(c, addressee, event)
+}
+
+//relayEvent - validates and delivers offer, answer or candidate to
+//addressee, candidates buffered for it are released after description.
+func relayEvent(c *Client, addressee *Client, event Event) {
+	if event.Action != EVENT_CANDIDATE_CONNECTION && !inspectSDP(c, addressee, &event) {
+		return
+	}
+	if !enforcePolicy(c, addressee, &event) {
+		return
+	}
+	if !trackNegotiation(c, addressee, event) {
+		return
+	}
 	bts, err := jsoniter.Marshal(event)
 	if err != nil {
-		log.Println("consumeDirectRawEvent", err)
+		log.Println("relayEvent", err)
 		return
 	}
 	addressee.Send(bts)
+	if event.Action != EVENT_CANDIDATE_CONNECTION {
+		releaseCandidates(c, addressee, event.Session)
+	}
 }
 
 func consumeGetHubs(c *Client, event Event) {
+	var filter HubsFilter
+	if event.Payload != nil {
+		if err := jsoniter.Unmarshal(*event.Payload, &filter); err != nil {
+			log.Println("consumeGetHubs", err)
+		}
+	}
+	hubs, cursor := listHubs(c.Hub.cluster.Hubs(), filter)
 	bts, err := jsoniter.Marshal(EventAllHubs{
 		EventHead: &EventHead{
 			Id:     event.Id,
@@ -221,7 +461,8 @@ func consumeGetHubs(c *Client, event Event) {
 			To:     c.Name,
 		},
 		Payload: AllPayload{
-			Hubs: c.Hub.cluster.All(),
+			Hubs:   hubs,
+			Cursor: cursor,
 		},
 	})
 	if err != nil {
@@ -232,6 +473,12 @@ func consumeGetHubs(c *Client, event Event) {
 }
 
 func consumeGetClients(c *Client, event Event) {
+	media := c.Hub.Media()
+	for name := range media {
+		if !c.Hub.visible(c.Name, name) {
+			delete(media, name)
+		}
+	}
 	bts, err := jsoniter.Marshal(EventGetClients{
 		EventHead: &EventHead{
 			Id:     event.Id,
@@ -239,7 +486,8 @@ func consumeGetClients(c *Client, event Event) {
 			To:     c.Name,
 		},
 		Payload: GetClientsPayload{
-			Clients: c.Hub.All(),
+			Clients: c.Hub.visibleTo(c.Name, c.Hub.All()),
+			Media:   media,
 		},
 	})
 	if err != nil {
@@ -290,6 +538,25 @@ func consumeClientReplyRequest(c *Client, event Event) {
 	}
 }
 
+func sendError(c *Client, id string, code int, info string) {
+	bts, err := jsoniter.Marshal(EventError{
+		EventHead: &EventHead{
+			Id:     id,
+			Action: EVENT_ERROR,
+			To:     c.Name,
+		},
+		Payload: ErrorPayload{
+			Code: code,
+			Info: info,
+		},
+	})
+	if err != nil {
+		log.Println("sendError", err)
+		return
+	}
+	c.Send(bts)
+}
+
 func clientNotFound(c *Client, name string, id string) {
 	bts, err := jsoniter.Marshal(EventError{
 		EventHead: &EventHead{
@@ -298,6 +565,7 @@ func clientNotFound(c *Client, name string, id string) {
 			To:     c.Name,
 		},
 		Payload: ErrorPayload{
+			Code: ERROR_CLIENT_NOT_FOUND,
 			Info: fmt.Sprintf("Client with name %s not found in your space", name),
 		},
 	})
@@ -316,6 +584,7 @@ func clientAnswerTimeout(c *Client, name string, id string) {
 			To:     c.Name,
 		},
 		Payload: ErrorPayload{
+			Code: ERROR_CLIENT_TIMEOUT,
 			Info: fmt.Sprintf("Client with name %s didn't repond", name),
 		},
 	})
@@ -334,6 +603,7 @@ func clientNotWaiting(c *Client, name string, id string) {
 			To:     c.Name,
 		},
 		Payload: ErrorPayload{
+			Code: ERROR_CLIENT_NOT_WAITING,
 			Info: fmt.Sprintf("Client %s is not waiting for response on message with id %s", name, id),
 		},
 	})
@@ -352,6 +622,7 @@ func hubNotFound(c *Client, hubId string, id string) {
 			To:     c.Name,
 		},
 		Payload: ErrorPayload{
+			Code: ERROR_HUB_NOT_FOUND,
 			Info: fmt.Sprintf("Hub with id %s not found", hubId),
 		},
 	})
@@ -370,6 +641,7 @@ func hubAlreadyExist(c *Client, hubId string, id string) {
 			To:     c.Name,
 		},
 		Payload: ErrorPayload{
+			Code: ERROR_HUB_EXISTS,
 			Info: fmt.Sprintf("Hub with id %s already exist", hubId),
 		},
 	})
@@ -380,6 +652,63 @@ func hubAlreadyExist(c *Client, hubId string, id string) {
 	c.Send(bts)
 }
 
+func hubIsFull(c *Client, hubId string, id string) {
+	bts, err := jsoniter.Marshal(EventError{
+		EventHead: &EventHead{
+			Id:     id,
+			Action: EVENT_ERROR,
+			To:     c.Name,
+		},
+		Payload: ErrorPayload{
+			Code: ERROR_HUB_FULL,
+			Info: fmt.Sprintf("Hub with id %s is full", hubId),
+		},
+	})
+	if err != nil {
+		log.Println("hubIsFull", err)
+		return
+	}
+	c.Send(bts)
+}
+
+func accessDenied(c *Client, hubId string, reason error, id string) {
+	bts, err := jsoniter.Marshal(EventError{
+		EventHead: &EventHead{
+			Id:     id,
+			Action: EVENT_ERROR,
+			To:     c.Name,
+		},
+		Payload: ErrorPayload{
+			Code: ERROR_ACCESS_DENIED,
+			Info: fmt.Sprintf("Access to hub with id %s denied: %s", hubId, reason),
+		},
+	})
+	if err != nil {
+		log.Println("accessDenied", err)
+		return
+	}
+	c.Send(bts)
+}
+
+func notHubOwner(c *Client, hubId string, id string) {
+	bts, err := jsoniter.Marshal(EventError{
+		EventHead: &EventHead{
+			Id:     id,
+			Action: EVENT_ERROR,
+			To:     c.Name,
+		},
+		Payload: ErrorPayload{
+			Code: ERROR_NOT_OWNER,
+			Info: fmt.Sprintf("Only owners of hub with id %s can do that", hubId),
+		},
+	})
+	if err != nil {
+		log.Println("notHubOwner", err)
+		return
+	}
+	c.Send(bts)
+}
+
 func confirmAction(c *Client, id string) {
 	bts, err := jsoniter.Marshal(EventConfirm{
 		EventHead: &EventHead{
@@ -417,6 +746,12 @@ func emitNewHubCreated(c *Client, name string) {
 }
 
 func emitClientConnected(c *Client, hub *Hub) {
+	if bts := getClientConnected(c.Name); bts != nil {
+		hub.EmitAbout(c.Name, bts)
+	}
+}
+
+func getClientConnected(name string) []byte {
 	bts, err := jsoniter.Marshal(EventClientConnected{
 		EventHead: &EventHead{
 			Id:     randomId(IdLength),
@@ -424,14 +759,14 @@ func emitClientConnected(c *Client, hub *Hub) {
 			To:     TO_EVERYONE,
 		},
 		Payload: ClientConnectPayload{
-			Name: c.Name,
+			Name: name,
 		},
 	})
 	if err != nil {
-		log.Println("emitNewHubCreated", err)
-		return
+		log.Println("emitClientConnected", err)
+		return nil
 	}
-	hub.Emit(bts)
+	return bts
 }
 
 func getClientRemoved(name string) []byte {
@@ -0,0 +1,271 @@
+package room
+
+import (
+	"fmt"
+	"github.com/json-iterator/go"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	EVENT_PEER_STATE  = "EVENT_PEER_STATE"
+	EVENT_PEER_FAILED = "EVENT_PEER_FAILED"
+
+	EDGE_PENDING   = "pending"
+	EDGE_CONNECTED = "connected"
+	EDGE_FAILED    = "failed"
+	EDGE_CLOSED    = "closed"
+)
+
+//edgeStates - RTCPeerConnection states reported by clients mapped to
+//states of the graph edge.
+var edgeStates = map[string]string{
+	"new":          EDGE_PENDING,
+	"connecting":   EDGE_PENDING,
+	"disconnected": EDGE_PENDING,
+	"connected":    EDGE_CONNECTED,
+	"failed":       EDGE_FAILED,
+	"closed":       EDGE_CLOSED,
+}
+
+type EventPeerState struct {
+	*EventHead
+	Payload PeerStatePayload `json:"payload"`
+}
+
+//PeerStatePayload - connection state of the client with the peer, sent
+//by clients on every transition and by server in EVENT_PEER_FAILED.
+type PeerStatePayload struct {
+	Peer  string `json:"peer"`
+	State string `json:"state"`
+}
+
+//GraphEdge - connection between two members of the hub. State is the
+//latest transition reported by either peer, Reported keeps connection
+//state as seen by each of them.
+type GraphEdge struct {
+	Peers     [2]string         `json:"peers"`
+	State     string            `json:"state"`
+	Reported  map[string]string `json:"reported"`
+	UpdatedAt int64             `json:"updatedAt"`
+}
+
+//HubGraph - members of the hub and connections between them.
+type HubGraph struct {
+	Hub   string      `json:"hub"`
+	Nodes []string    `json:"nodes"`
+	Edges []GraphEdge `json:"edges"`
+}
+
+//Graphs - per hub graphs of peer connections reported by clients.
+type Graphs struct {
+	mx    sync.Mutex
+	edges map[[3]string]*GraphEdge
+}
+
+func NewGraphs() *Graphs {
+	return &Graphs{
+		edges: make(map[[3]string]*GraphEdge),
+	}
+}
+
+//report - applies transition reported by the client, returns true if
+//the edge just failed.
+func (g *Graphs) report(hub string, from string, peer string, state string) bool {
+	g.mx.Lock()
+	defer g.mx.Unlock()
+	key := hubPairKey(hub, from, peer)
+	edge := g.edges[key]
+	if edge == nil {
+		edge = &GraphEdge{
+			Peers:    [2]string{key[1], key[2]},
+			Reported: make(map[string]string),
+		}
+		g.edges[key] = edge
+	}
+	previous := edge.State
+	edge.Reported[from] = state
+	edge.State = edgeStates[state]
+	edge.UpdatedAt = time.Now().Unix()
+	return edge.State == EDGE_FAILED && previous != EDGE_FAILED
+}
+
+//graph - returns edges of the hub with nodes of members and of peers
+//the members reported.
+func (g *Graphs) graph(hub string, members []string) HubGraph {
+	g.mx.Lock()
+	defer g.mx.Unlock()
+	nodes := make(map[string]bool)
+	for _, name := range members {
+		nodes[name] = true
+	}
+	result := HubGraph{
+		Hub:   hub,
+		Nodes: []string{},
+		Edges: []GraphEdge{},
+	}
+	for key, edge := range g.edges {
+		if key[0] != hub {
+			continue
+		}
+		copied := *edge
+		copied.Reported = make(map[string]string, len(edge.Reported))
+		for name, state := range edge.Reported {
+			copied.Reported[name] = state
+		}
+		result.Edges = append(result.Edges, copied)
+		nodes[key[1]] = true
+		nodes[key[2]] = true
+	}
+	for name := range nodes {
+		result.Nodes = append(result.Nodes, name)
+	}
+	sort.Strings(result.Nodes)
+	sort.Slice(result.Edges, func(i, j int) bool {
+		if result.Edges[i].Peers[0] != result.Edges[j].Peers[0] {
+			return result.Edges[i].Peers[0] < result.Edges[j].Peers[0]
+		}
+		return result.Edges[i].Peers[1] < result.Edges[j].Peers[1]
+	})
+	return result
+}
+
+//hubs - returns ids of hubs having reported edges.
+func (g *Graphs) hubs() []string {
+	g.mx.Lock()
+	defer g.mx.Unlock()
+	found := make(map[string]bool)
+	for key := range g.edges {
+		found[key[0]] = true
+	}
+	result := make([]string, 0, len(found))
+	for hub := range found {
+		result = append(result, hub)
+	}
+	return result
+}
+
+//drop - removes edges of disconnected client.
+func (g *Graphs) drop(name string) {
+	g.mx.Lock()
+	defer g.mx.Unlock()
+	for key := range g.edges {
+		if key[1] == name || key[2] == name {
+			delete(g.edges, key)
+		}
+	}
+}
+
+//leave - forgets edges of client which left the hub.
+func (g *Graphs) leave(hub string, name string) {
+	g.mx.Lock()
+	defer g.mx.Unlock()
+	for key := range g.edges {
+		if key[0] == hub && (key[1] == name || key[2] == name) {
+			delete(g.edges, key)
+		}
+	}
+}
+
+func (g *Graphs) dropHub(hub string) {
+	g.mx.Lock()
+	defer g.mx.Unlock()
+	for key := range g.edges {
+		if key[0] == hub {
+			delete(g.edges, key)
+		}
+	}
+}
+
+//GraphDOT - renders graphs in Graphviz DOT format, one cluster per hub.
+func GraphDOT(graphs []HubGraph) string {
+	colors := map[string]string{
+		EDGE_PENDING:   "gray",
+		EDGE_CONNECTED: "darkgreen",
+		EDGE_FAILED:    "red",
+		EDGE_CLOSED:    "lightgray",
+	}
+	var b strings.Builder
+	b.WriteString("graph signaller {\n")
+	for i, graph := range graphs {
+		fmt.Fprintf(&b, "  subgraph cluster_%d {\n", i)
+		fmt.Fprintf(&b, "    label=%s;\n", dotQuote(graph.Hub))
+		for _, node := range graph.Nodes {
+			fmt.Fprintf(&b, "    %s;\n", dotQuote(graph.Hub+"/"+node))
+		}
+		for _, edge := range graph.Edges {
+			style := ""
+			if edge.State == EDGE_FAILED || edge.State == EDGE_PENDING {
+				style = ", style=dashed"
+			}
+			fmt.Fprintf(&b, "    %s -- %s [label=%s, color=%s%s];\n",
+				dotQuote(graph.Hub+"/"+edge.Peers[0]), dotQuote(graph.Hub+"/"+edge.Peers[1]),
+				dotQuote(edge.State), colors[edge.State], style)
+		}
+		b.WriteString("  }\n")
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+func dotQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
+
+func consumePeerState(c *Client, event Event) {
+	var payload PeerStatePayload
+	if event.Payload != nil {
+		if err := jsoniter.Unmarshal(*event.Payload, &payload); err != nil {
+			log.Println("consumePeerState", err)
+		}
+	}
+	if _, ok := edgeStates[payload.State]; !ok || payload.Peer == c.Name {
+		sendError(c, event.Id, ERROR_INVALID_PEER_STATE, fmt.Sprintf("Unknown state %s of connection with %s", payload.State, payload.Peer))
+		return
+	}
+	cluster := c.Hub.cluster
+	if !reportable(c, payload.Peer) {
+		clientNotFound(c, payload.Peer, event.Id)
+		return
+	}
+	peer := c.Hub.Get(payload.Peer)
+	if cluster.graphs.report(c.Hub.ID, c.Name, payload.Peer, payload.State) {
+		log.Printf("Connection %s - %s in hub %s failed", c.Name, payload.Peer, c.Hub.ID)
+		sendPeerFailed(c, payload.Peer)
+		if peer != nil {
+			sendPeerFailed(peer, c.Name)
+		}
+	}
+	if c.Hub.Options.Mesh && payload.State == "connected" {
+		c.Hub.listener <- commandData{
+			action: meshConnected,
+			key:    c.Name,
+			peer:   payload.Peer,
+		}
+	}
+	confirmAction(c, event.Id)
+}
+
+//sendPeerFailed - tells client that connection with the peer failed,
+//so it can restart ICE or fall back to relay stream.
+func sendPeerFailed(c *Client, peer string) {
+	bts, err := jsoniter.Marshal(EventPeerState{
+		EventHead: &EventHead{
+			Id:     randomId(IdLength),
+			Action: EVENT_PEER_FAILED,
+			To:     c.Name,
+		},
+		Payload: PeerStatePayload{
+			Peer:  peer,
+			State: EDGE_FAILED,
+		},
+	})
+	if err != nil {
+		log.Println("sendPeerFailed", err)
+		return
+	}
+	c.Send(bts)
+}
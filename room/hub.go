@@ -2,7 +2,9 @@ package room
 
 import (
 	"fmt"
+	"golang.org/x/crypto/bcrypt"
 	"log"
+	"time"
 )
 
 const (
@@ -13,6 +15,21 @@ const (
 	length
 	die
 	all
+	list
+	meshConnected
+	media
+	mediaUpdate
+	mediaRemove
+	mediaMute
+	speakerLevel
+	speakerSpotlight
+	stagePromote
+	stageDemote
+	handRaise
+	handLower
+	floorGrant
+	addAll
+	breakoutMove
 )
 
 type commandAction int
@@ -26,21 +43,102 @@ type commandData struct {
 	all     chan<- []string
 	data    []byte
 	client  *Client
+	peer    string
+	track   *MediaTrack
+	mute    *MuteRequestPayload
+	media   chan<- map[string][]MediaTrack
+	level   float64
+	//disconnected - set on remove of client which lost connection.
+	disconnected bool
+	//detached - set on add of client already removed from its hub.
+	detached bool
+	moves    map[string]*Hub
+}
+
+//HubOptions - settings provided on hub creation.
+type HubOptions struct {
+	Tags       []string          `json:"tags,omitempty"`
+	Metadata   map[string]string `json:"metadata,omitempty"`
+	Private    bool              `json:"private,omitempty"`
+	MaxClients int               `json:"maxClients,omitempty"`
+	Access     string            `json:"access,omitempty"`
+	Password   string            `json:"password,omitempty"`
+	Owners     []string          `json:"owners,omitempty"`
+	Lobby      bool              `json:"lobby,omitempty"`
+
+	Mesh          bool   `json:"mesh,omitempty"`
+	MeshInitiator string `json:"meshInitiator,omitempty"`
+
+	SDPValidation string `json:"sdpValidation,omitempty"`
+
+	SFU bool `json:"sfu,omitempty"`
+
+	Stage      bool     `json:"stage,omitempty"`
+	Publishers []string `json:"publishers,omitempty"`
 }
 
 type Hub struct {
-	listener chan commandData
-	pool     map[string]*Client
-	cluster  *Cluster
-	ID       string
+	listener  chan commandData
+	pool      map[string]*Client
+	cluster   *Cluster
+	ID        string
+	CreatedAt time.Time
+	Options   HubOptions
+	//Parent - id of the hub this breakout hub was opened from.
+	Parent string
+
+	invites      *InviteTokens
+	passwordHash []byte
+	mesh         *meshState
+	media        *mediaState
+	speaker      *speakerState
+	stage        *stageState
+	breakouts    *breakoutState
+	queue        *queueState
 }
 
 func NewHub(id string, cluster *Cluster) *Hub {
+	return NewHubWithOptions(id, cluster, HubOptions{})
+}
+
+func NewHubWithOptions(id string, cluster *Cluster, options HubOptions) *Hub {
 	hub := Hub{
-		listener: make(chan commandData),
-		pool:     make(map[string]*Client),
-		ID:       id,
-		cluster:  cluster,
+		listener:  make(chan commandData),
+		pool:      make(map[string]*Client),
+		ID:        id,
+		cluster:   cluster,
+		CreatedAt: time.Now(),
+		Options:   options,
+		invites:   NewInviteTokens(),
+		mesh:      newMeshState(),
+		media:     newMediaState(),
+		speaker:   newSpeakerState(),
+		stage:     newStageState(options.Publishers),
+		breakouts: &breakoutState{},
+		queue:     newQueueState(),
+	}
+	if hub.Options.Access == "" {
+		hub.Options.Access = ACCESS_OPEN
+	}
+	if hub.Options.Password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(hub.Options.Password), bcrypt.DefaultCost)
+		if err != nil {
+			log.Printf("Hub %s password can't be hashed: %s", id, err)
+		}
+		hub.passwordHash = hash
+		hub.Options.Password = ""
+	}
+	if hub.Options.Stage {
+		// viewers can't see each other, so they can't form a mesh
+		hub.Options.Mesh = false
+	}
+	if hub.Options.Mesh {
+		if hub.Options.MaxClients <= 0 {
+			hub.Options.MaxClients = DefaultMeshSize
+		}
+		if hub.Options.MaxClients > MaxMeshSize {
+			hub.Options.MaxClients = MaxMeshSize
+		}
 	}
 	log.Println(fmt.Sprintf("Hub with ID %s created...", hub.ID))
 	go hub.run()
@@ -58,27 +156,80 @@ func (hub *Hub) run() {
 			command.all <- all
 		case add:
 			hub.pool[command.client.Name] = command.client
-			command.client.attachToHub(hub)
+			command.client.attachToHub(hub, command.detached)
+			hub.cluster.clients.set(command.client, hub)
+			if hub.Options.Mesh {
+				hub.meshJoin(command.client)
+			}
+			hub.sendMediaState(command.client)
+			hub.sendSpeaker(command.client)
+			hub.queueJoin(command.client)
 		case get:
 			command.result <- hub.pool[command.key]
 		case remove:
-			delete(hub.pool, command.key)
-			data := getClientRemoved(command.key)
-			for _, client := range hub.pool {
-				client.Send(data)
-			}
+			hub.removeClient(command.key, command.disconnected)
 		case length:
 			command.length <- len(hub.pool)
 		case emit:
 			for _, client := range hub.pool {
-				client.Send(command.data)
+				if command.key == "" || hub.visible(client.Name, command.key) {
+					client.Send(command.data)
+				}
 			}
+		case meshConnected:
+			hub.meshConfirm(command.key, command.peer)
+		case media:
+			command.media <- hub.mediaSnapshot()
+		case mediaUpdate:
+			hub.mediaUpdate(command.key, *command.track)
+		case mediaRemove:
+			hub.mediaRemove(command.key, command.peer)
+		case mediaMute:
+			hub.mediaMute(*command.mute)
+		case speakerLevel:
+			hub.speakerLevel(command.key, command.level)
+		case speakerSpotlight:
+			hub.speakerSpotlight(command.peer)
+		case stagePromote:
+			hub.stageRole(command.key, true)
+			hub.queueRoleChanged()
+		case stageDemote:
+			hub.stageRole(command.key, false)
+			hub.queueRoleChanged()
+		case handRaise:
+			hub.queueRaise(command.key)
+		case handLower:
+			hub.queueLower(command.key)
+		case floorGrant:
+			hub.queueGrant(command.key)
+		case breakoutMove:
+			command.all <- hub.breakoutMove(command.moves)
 		case die:
 			return
 		}
 	}
 }
 
+//removeClient - forgets the client and tells the rest of the hub.
+func (hub *Hub) removeClient(key string, disconnected bool) {
+	hub.cluster.clients.drop(hub.pool[key], hub)
+	delete(hub.pool, key)
+	delete(hub.media.tracks, key)
+	data := getClientRemoved(key)
+	for _, client := range hub.pool {
+		if hub.visible(client.Name, key) {
+			client.Send(data)
+		}
+	}
+	if hub.Options.Mesh {
+		hub.meshLeave(key)
+	}
+	hub.speakerLeave(key)
+	hub.queueLeave(key, disconnected)
+	hub.cluster.stats.leave(hub.ID, key)
+	hub.cluster.graphs.leave(hub.ID, key)
+}
+
 func (hub *Hub) All() []string {
 	result := make(chan []string)
 	hub.listener <- commandData{
@@ -114,6 +265,28 @@ func (hub *Hub) Length() int {
 	return <-lnth
 }
 
+//HasSpace - reports whether hub can accept one more client.
+func (hub *Hub) HasSpace() bool {
+	return hub.Options.MaxClients <= 0 || hub.Length() < hub.Options.MaxClients
+}
+
+//Info - returns listing information about the hub.
+func (hub *Hub) Info() HubInfo {
+	return HubInfo{
+		Name:       hub.ID,
+		Members:    hub.Length(),
+		MaxClients: hub.Options.MaxClients,
+		CreatedAt:  hub.CreatedAt.Unix(),
+		Access:     hub.Options.Access,
+		Tags:       hub.Options.Tags,
+		Metadata:   hub.Options.Metadata,
+		SFU:        hub.Options.SFU,
+		Stage:      hub.Options.Stage,
+		Parent:     hub.Parent,
+		Breakouts:  hub.breakouts.list(),
+	}
+}
+
 func (hub *Hub) Remove(key string) {
 	hub.listener <- commandData{
 		action: remove,
@@ -0,0 +1,128 @@
+package room
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	SORT_BY_NAME    = "name"
+	SORT_BY_CREATED = "created"
+	SORT_BY_MEMBERS = "members"
+
+	DefaultHubsLimit = 50
+	MaxHubsLimit     = 500
+)
+
+//HubInfo - public description of a hub returned on listing.
+type HubInfo struct {
+	Name       string            `json:"name"`
+	Members    int               `json:"members"`
+	MaxClients int               `json:"maxClients,omitempty"`
+	CreatedAt  int64             `json:"createdAt"`
+	Access     string            `json:"access"`
+	Tags       []string          `json:"tags,omitempty"`
+	Metadata   map[string]string `json:"metadata,omitempty"`
+	SFU        bool              `json:"sfu,omitempty"`
+	Stage      bool              `json:"stage,omitempty"`
+	Parent     string            `json:"parent,omitempty"`
+	Breakouts  []string          `json:"breakouts,omitempty"`
+}
+
+//HubsFilter - search, sort and paging parameters of EVENT_GET_HUBS.
+type HubsFilter struct {
+	Prefix       string            `json:"prefix,omitempty"`
+	Parent       string            `json:"parent,omitempty"`
+	Tag          string            `json:"tag,omitempty"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
+	HasSpace     bool              `json:"hasSpace,omitempty"`
+	IncludeEmpty bool              `json:"includeEmpty,omitempty"`
+	Sort         string            `json:"sort,omitempty"`
+	Desc         bool              `json:"desc,omitempty"`
+	Limit        int               `json:"limit,omitempty"`
+	Cursor       string            `json:"cursor,omitempty"`
+}
+
+func (f HubsFilter) match(info HubInfo) bool {
+	if f.Prefix != "" && !strings.HasPrefix(info.Name, f.Prefix) {
+		return false
+	}
+	if f.Parent != "" && info.Parent != f.Parent {
+		return false
+	}
+	if f.Tag != "" && !containsString(info.Tags, f.Tag) {
+		return false
+	}
+	for key, value := range f.Metadata {
+		if v, ok := info.Metadata[key]; !ok || v != value {
+			return false
+		}
+	}
+	if f.HasSpace && info.MaxClients > 0 && info.Members >= info.MaxClients {
+		return false
+	}
+	if !f.IncludeEmpty && info.Members == 0 {
+		return false
+	}
+	return true
+}
+
+func (f HubsFilter) less(a, b HubInfo) bool {
+	switch f.Sort {
+	case SORT_BY_CREATED:
+		if a.CreatedAt != b.CreatedAt {
+			return a.CreatedAt < b.CreatedAt
+		}
+	case SORT_BY_MEMBERS:
+		if a.Members != b.Members {
+			return a.Members < b.Members
+		}
+	}
+	return a.Name < b.Name
+}
+
+//listHubs - applies filter to the cluster hubs, returns requested page
+//of the result and cursor of the next page, empty if there is no more.
+func listHubs(hubs []*Hub, f HubsFilter) ([]HubInfo, string) {
+	result := make([]HubInfo, 0, len(hubs))
+	for _, hub := range hubs {
+		if hub.Options.Private {
+			continue
+		}
+		if info := hub.Info(); f.match(info) {
+			result = append(result, info)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if f.Desc {
+			return f.less(result[j], result[i])
+		}
+		return f.less(result[i], result[j])
+	})
+	offset, _ := strconv.Atoi(f.Cursor)
+	if offset < 0 || offset > len(result) {
+		offset = len(result)
+	}
+	limit := f.Limit
+	if limit <= 0 {
+		limit = DefaultHubsLimit
+	}
+	if limit > MaxHubsLimit {
+		limit = MaxHubsLimit
+	}
+	end := offset + limit
+	if end >= len(result) {
+		return result[offset:], ""
+	}
+	return result[offset:end], strconv.Itoa(end)
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,127 @@
+package room
+
+import (
+	"github.com/json-iterator/go"
+	"github.com/lempiy/Signaller/nat"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	EVENT_ICE_SERVERS = "EVENT_ICE_SERVERS"
+
+	DefaultICETTL      = time.Hour * 24
+	SessionTokenLength = 16
+)
+
+type EventICEServers struct {
+	*EventHead
+	Payload ICEServersPayload `json:"payload"`
+}
+
+//ICEServersPayload - Token is sent only over websocket, it authorizes
+//refresh of the credentials with GET /ice-servers.
+type ICEServersPayload struct {
+	ICEServers []ICEServer `json:"iceServers"`
+	TTL        int         `json:"ttl,omitempty"`
+	Token      string      `json:"token,omitempty"`
+}
+
+//ICEServer - entry of RTCConfiguration.iceServers.
+type ICEServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+//ICEConfig - STUN and TURN servers distributed to clients. TURN
+//credentials are derived from Secret as described in TURN REST API.
+type ICEConfig struct {
+	STUN   []string
+	TURN   []string
+	Secret string
+	TTL    time.Duration
+}
+
+//ICE - active ICE configuration of the cluster.
+type ICE struct {
+	mx     sync.RWMutex
+	config ICEConfig
+}
+
+func NewICE() *ICE {
+	return &ICE{}
+}
+
+func (ice *ICE) Set(config ICEConfig) {
+	ice.mx.Lock()
+	defer ice.mx.Unlock()
+	if config.TTL <= 0 {
+		config.TTL = DefaultICETTL
+	}
+	ice.config = config
+}
+
+//AddSTUN - advertises one more STUN server to clients.
+func (ice *ICE) AddSTUN(url string) {
+	ice.mx.Lock()
+	defer ice.mx.Unlock()
+	ice.config.STUN = append(ice.config.STUN, url)
+}
+
+//AddTURN - advertises one more TURN server to clients.
+func (ice *ICE) AddTURN(url string) {
+	ice.mx.Lock()
+	defer ice.mx.Unlock()
+	ice.config.TURN = append(ice.config.TURN, url)
+}
+
+//Servers - returns ICE servers for the client with the name.
+func (ice *ICE) Servers(name string) ([]ICEServer, time.Duration) {
+	ice.mx.RLock()
+	defer ice.mx.RUnlock()
+	servers := []ICEServer{}
+	if len(ice.config.STUN) > 0 {
+		servers = append(servers, ICEServer{URLs: ice.config.STUN})
+	}
+	if len(ice.config.TURN) > 0 && ice.config.Secret != "" {
+		username, credential := TURNCredentials(ice.config.Secret, name, ice.config.TTL)
+		servers = append(servers, ICEServer{
+			URLs:       ice.config.TURN,
+			Username:   username,
+			Credential: credential,
+		})
+	}
+	return servers, ice.config.TTL
+}
+
+//TURNCredentials - generates time limited TURN credentials for name,
+//username is "expiry:name", credential is base64 HMAC-SHA1 of it.
+func TURNCredentials(secret string, name string, ttl time.Duration) (string, string) {
+	username := strconv.FormatInt(time.Now().Add(ttl).Unix(), 10) + ":" + name
+	return username, nat.TURNPassword(secret, username)
+}
+
+func consumeGetICEServers(c *Client, event Event) {
+	sendICEServers(c.Hub.cluster, c, event.Id)
+}
+
+func sendICEServers(cluster *Cluster, c *Client, id string) {
+	payload := cluster.ICEServers(c.Name)
+	payload.Token = c.session
+	bts, err := jsoniter.Marshal(EventICEServers{
+		EventHead: &EventHead{
+			Id:     id,
+			Action: EVENT_ICE_SERVERS,
+			To:     c.Name,
+		},
+		Payload: payload,
+	})
+	if err != nil {
+		log.Println("sendICEServers", err)
+		return
+	}
+	c.Send(bts)
+}
@@ -0,0 +1,153 @@
+package room
+
+import (
+	"fmt"
+	"github.com/json-iterator/go"
+	"log"
+	"time"
+)
+
+const (
+	EVENT_HUB_INVITE          = "EVENT_HUB_INVITE"
+	EVENT_HUB_INVITE_RESPONSE = "EVENT_HUB_INVITE_RESPONSE"
+
+	DirectInviteTTL = time.Minute * 5
+)
+
+type EventHubInvite struct {
+	*EventHead
+	Payload HubInvitePayload `json:"payload"`
+}
+
+type EventHubInviteResponse struct {
+	*EventHead
+	Payload HubInviteResponsePayload `json:"payload"`
+}
+
+type HubInvitePayload struct {
+	Hub       string `json:"hub"`
+	Inviter   string `json:"inviter"`
+	Message   string `json:"message,omitempty"`
+	Token     string `json:"token,omitempty"`
+	ExpiresAt int64  `json:"expiresAt,omitempty"`
+}
+
+type HubInviteResponsePayload struct {
+	Hub     string `json:"hub"`
+	Inviter string `json:"inviter"`
+	Invitee string `json:"invitee"`
+	Token   string `json:"token,omitempty"`
+	Accept  bool   `json:"accept"`
+}
+
+//consumeHubInvite - delivers invitation into a hub to client event.To,
+//the invitation carries single use token so the invitee can join
+//even a locked hub.
+func consumeHubInvite(c *Client, event Event) {
+	var payload HubInvitePayload
+	if event.Payload != nil {
+		if err := jsoniter.Unmarshal(*event.Payload, &payload); err != nil {
+			log.Println("consumeHubInvite", err)
+		}
+	}
+	hub := c.Hub.cluster.Get(payload.Hub)
+	if hub == nil {
+		hubNotFound(c, payload.Hub, event.Id)
+		return
+	}
+	if !hub.IsOwner(c.Name) && hub.Get(c.Name) == nil {
+		sendError(c, event.Id, ERROR_ACCESS_DENIED,
+			fmt.Sprintf("Only members of hub with id %s can invite to it", hub.ID))
+		return
+	}
+	invitee := c.Hub.cluster.FindClient(event.To)
+	if invitee == nil {
+		clientNotFound(c, event.To, event.Id)
+		return
+	}
+	if invitee.Hub == hub {
+		sendError(c, event.Id, ERROR_ACCESS_DENIED,
+			fmt.Sprintf("Client %s is already in hub with id %s", invitee.Name, hub.ID))
+		return
+	}
+	token, expiresAt := hub.invites.Mint(DirectInviteTTL, 1)
+	bts, err := jsoniter.Marshal(EventHubInvite{
+		EventHead: &EventHead{
+			Id:     event.Id,
+			Action: EVENT_HUB_INVITE,
+			To:     invitee.Name,
+		},
+		Payload: HubInvitePayload{
+			Hub:       hub.ID,
+			Inviter:   c.Name,
+			Message:   payload.Message,
+			Token:     token,
+			ExpiresAt: expiresAt.Unix(),
+		},
+	})
+	if err != nil {
+		log.Println("consumeHubInvite", err)
+		return
+	}
+	invitee.Send(bts)
+	confirmAction(c, event.Id)
+}
+
+//consumeHubInviteResponse - accepts or declines invitation, accepted
+//invitation moves the invitee into the hub. Inviter gets notified
+//about the decision in both cases.
+func consumeHubInviteResponse(c *Client, event Event) {
+	var payload HubInviteResponsePayload
+	if event.Payload != nil {
+		if err := jsoniter.Unmarshal(*event.Payload, &payload); err != nil {
+			log.Println("consumeHubInviteResponse", err)
+		}
+	}
+	hub := c.Hub.cluster.Get(payload.Hub)
+	if hub == nil {
+		hubNotFound(c, payload.Hub, event.Id)
+		return
+	}
+	payload.Invitee = c.Name
+	if !payload.Accept {
+		hub.invites.Revoke(payload.Token)
+		notifyInviter(c, payload, event.Id)
+		confirmAction(c, event.Id)
+		return
+	}
+	if !hub.HasSpace() {
+		hubIsFull(c, hub.ID, event.Id)
+		return
+	}
+	if err := hub.Admit(c.Name, Credentials{Token: payload.Token}); err != nil {
+		accessDenied(c, hub.ID, err, event.Id)
+		return
+	}
+	notifyInviter(c, payload, event.Id)
+	joinHub(c, hub, event.Id)
+}
+
+func notifyInviter(c *Client, payload HubInviteResponsePayload, id string) {
+	inviter := c.Hub.cluster.FindClient(payload.Inviter)
+	if inviter == nil {
+		return
+	}
+	bts, err := jsoniter.Marshal(EventHubInviteResponse{
+		EventHead: &EventHead{
+			Id:     id,
+			Action: EVENT_HUB_INVITE_RESPONSE,
+			To:     inviter.Name,
+		},
+		Payload: HubInviteResponsePayload{
+			Hub:     payload.Hub,
+			Inviter: payload.Inviter,
+			Invitee: payload.Invitee,
+			Accept:  payload.Accept,
+		},
+	})
+	if err != nil {
+		log.Println("notifyInviter", err)
+		return
+	}
+	inviter.Send(bts)
+}
@@ -0,0 +1,165 @@
+package room
+
+import (
+	"fmt"
+	"github.com/json-iterator/go"
+	"log"
+	"time"
+)
+
+const (
+	EVENT_JOIN_REQUEST  = "EVENT_JOIN_REQUEST"
+	EVENT_JOIN_RESPONSE = "EVENT_JOIN_RESPONSE"
+	EVENT_JOIN_PENDING  = "EVENT_JOIN_PENDING"
+
+	LobbyTimeout = time.Minute
+)
+
+type EventJoinRequest struct {
+	*EventHead
+	Payload JoinRequestPayload `json:"payload"`
+}
+
+type JoinRequestPayload struct {
+	Hub      string            `json:"hub"`
+	Name     string            `json:"name"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+type JoinResponsePayload struct {
+	Hub     string `json:"hub"`
+	Name    string `json:"name"`
+	Approve bool   `json:"approve"`
+}
+
+func lobbyKey(hubID string, name string) string {
+	return "lobby:" + hubID + ":" + name
+}
+
+//knockHub - parks client c in the lobby of a locked hub until one of
+//the hub owners approves or denies the request, or it times out.
+func knockHub(c *Client, hub *Hub, metadata map[string]string, id string) {
+	var owners []*Client
+	for _, name := range hub.All() {
+		if !hub.IsOwner(name) {
+			continue
+		}
+		if owner := hub.Get(name); owner != nil {
+			owners = append(owners, owner)
+		}
+	}
+	if len(owners) == 0 {
+		sendError(c, id, ERROR_JOIN_DENIED,
+			fmt.Sprintf("No owner of hub with id %s is online to approve the request", hub.ID))
+		return
+	}
+	key := lobbyKey(hub.ID, c.Name)
+	reply := make(chan Event, 1)
+	if err := eventsKeyQueue.Set(key, reply); err != nil {
+		sendError(c, id, ERROR_JOIN_DENIED,
+			fmt.Sprintf("Request to join hub with id %s is already pending", hub.ID))
+		return
+	}
+	defer eventsKeyQueue.Delete(key)
+
+	bts, err := jsoniter.Marshal(EventJoinRequest{
+		EventHead: &EventHead{
+			Id:     id,
+			Action: EVENT_JOIN_REQUEST,
+		},
+		Payload: JoinRequestPayload{
+			Hub:      hub.ID,
+			Name:     c.Name,
+			Metadata: metadata,
+		},
+	})
+	if err != nil {
+		log.Println("knockHub", err)
+		return
+	}
+	for _, owner := range owners {
+		owner.Send(bts)
+	}
+	emitJoinPending(c, hub.ID, id)
+
+	select {
+	case e := <-reply:
+		var payload JoinResponsePayload
+		if e.Payload != nil {
+			if err := jsoniter.Unmarshal(*e.Payload, &payload); err != nil {
+				log.Println("knockHub", err)
+			}
+		}
+		if !payload.Approve {
+			sendError(c, id, ERROR_JOIN_DENIED,
+				fmt.Sprintf("Request to join hub with id %s was denied", hub.ID))
+			return
+		}
+		// client might have disconnected while waiting in the lobby
+		if c.Hub.Get(c.Name) != c {
+			return
+		}
+		// and the hub might have been removed, its actor doesn't listen
+		if c.Hub.cluster.Get(hub.ID) != hub {
+			hubNotFound(c, hub.ID, id)
+			return
+		}
+		if !hub.HasSpace() {
+			hubIsFull(c, hub.ID, id)
+			return
+		}
+		joinHub(c, hub, id)
+	case <-time.After(LobbyTimeout):
+		sendError(c, id, ERROR_JOIN_TIMEOUT,
+			fmt.Sprintf("Request to join hub with id %s was not answered", hub.ID))
+	}
+}
+
+func consumeJoinResponse(c *Client, event Event) {
+	var payload JoinResponsePayload
+	if event.Payload != nil {
+		if err := jsoniter.Unmarshal(*event.Payload, &payload); err != nil {
+			log.Println("consumeJoinResponse", err)
+		}
+	}
+	hub := c.Hub.cluster.Get(payload.Hub)
+	if hub == nil {
+		hubNotFound(c, payload.Hub, event.Id)
+		return
+	}
+	if !hub.IsOwner(c.Name) {
+		notHubOwner(c, payload.Hub, event.Id)
+		return
+	}
+	ch := eventsKeyQueue.Get(lobbyKey(hub.ID, payload.Name))
+	if ch == nil {
+		clientNotWaiting(c, payload.Name, event.Id)
+		return
+	}
+	select {
+	case ch <- event:
+		confirmAction(c, event.Id)
+	default:
+		// another owner has already answered the request
+		clientNotWaiting(c, payload.Name, event.Id)
+	}
+}
+
+func emitJoinPending(c *Client, hubID string, id string) {
+	bts, err := jsoniter.Marshal(EventJoinRequest{
+		EventHead: &EventHead{
+			Id:     id,
+			Action: EVENT_JOIN_PENDING,
+			To:     c.Name,
+		},
+		Payload: JoinRequestPayload{
+			Hub:  hubID,
+			Name: c.Name,
+		},
+	})
+	if err != nil {
+		log.Println("emitJoinPending", err)
+		return
+	}
+	c.Send(bts)
+}
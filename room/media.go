@@ -0,0 +1,266 @@
+package room
+
+import (
+	"github.com/json-iterator/go"
+	"log"
+	"sort"
+)
+
+const (
+	EVENT_MEDIA_TRACK         = "EVENT_MEDIA_TRACK"
+	EVENT_MEDIA_TRACK_REMOVED = "EVENT_MEDIA_TRACK_REMOVED"
+	EVENT_MEDIA_STATE         = "EVENT_MEDIA_STATE"
+	EVENT_MUTE_REQUEST        = "EVENT_MUTE_REQUEST"
+
+	SOURCE_CAMERA     = "camera"
+	SOURCE_MICROPHONE = "microphone"
+	SOURCE_SCREEN     = "screen"
+)
+
+type EventMediaTrack struct {
+	*EventHead
+	Payload MediaTrackPayload `json:"payload"`
+}
+
+type EventMediaState struct {
+	*EventHead
+	Payload MediaStatePayload `json:"payload"`
+}
+
+type EventMuteRequest struct {
+	*EventHead
+	Payload MuteRequestPayload `json:"payload"`
+}
+
+//MediaTrack - metadata of track published by a client. MutedBy is set
+//when the track was muted on request of a moderator.
+type MediaTrack struct {
+	Id      string `json:"id"`
+	Kind    string `json:"kind"`
+	Label   string `json:"label,omitempty"`
+	Source  string `json:"source,omitempty"`
+	Muted   bool   `json:"muted"`
+	MutedBy string `json:"mutedBy,omitempty"`
+}
+
+type MediaTrackPayload struct {
+	Client string     `json:"client"`
+	Track  MediaTrack `json:"track"`
+}
+
+//MediaStatePayload - tracks of hub members by client name.
+type MediaStatePayload struct {
+	Media map[string][]MediaTrack `json:"media"`
+}
+
+//MuteRequestPayload - moderator request to mute tracks of the client
+//with the name or of everyone with "*", optionally of the kind only.
+type MuteRequestPayload struct {
+	Name string `json:"name"`
+	Kind string `json:"kind,omitempty"`
+	By   string `json:"by,omitempty"`
+}
+
+//mediaState - tracks of hub members, owned by the hub goroutine.
+type mediaState struct {
+	tracks map[string]map[string]*MediaTrack
+}
+
+func newMediaState() *mediaState {
+	return &mediaState{
+		tracks: make(map[string]map[string]*MediaTrack),
+	}
+}
+
+func (hub *Hub) mediaSnapshot() map[string][]MediaTrack {
+	result := make(map[string][]MediaTrack, len(hub.media.tracks))
+	for name, tracks := range hub.media.tracks {
+		list := make([]MediaTrack, 0, len(tracks))
+		for _, track := range tracks {
+			list = append(list, *track)
+		}
+		sort.Slice(list, func(i, j int) bool {
+			return list[i].Id < list[j].Id
+		})
+		result[name] = list
+	}
+	return result
+}
+
+//mediaUpdate - stores track announced by the client and broadcasts it.
+func (hub *Hub) mediaUpdate(name string, track MediaTrack) {
+	tracks := hub.media.tracks[name]
+	if tracks == nil {
+		tracks = make(map[string]*MediaTrack)
+		hub.media.tracks[name] = tracks
+	}
+	if previous := tracks[track.Id]; previous != nil && track.Muted {
+		track.MutedBy = previous.MutedBy
+	} else {
+		track.MutedBy = ""
+	}
+	tracks[track.Id] = &track
+	hub.broadcastMedia(EVENT_MEDIA_TRACK, name, track)
+}
+
+func (hub *Hub) mediaRemove(name string, id string) {
+	track := hub.media.tracks[name][id]
+	if track == nil {
+		return
+	}
+	delete(hub.media.tracks[name], id)
+	if len(hub.media.tracks[name]) == 0 {
+		delete(hub.media.tracks, name)
+	}
+	hub.broadcastMedia(EVENT_MEDIA_TRACK_REMOVED, name, *track)
+}
+
+//mediaMute - marks matching tracks muted and asks their owners to
+//stop sending media.
+func (hub *Hub) mediaMute(request MuteRequestPayload) {
+	for name, client := range hub.pool {
+		if name == request.By || (request.Name != TO_EVERYONE && request.Name != name) {
+			continue
+		}
+		for _, track := range hub.media.tracks[name] {
+			if track.Muted || (request.Kind != "" && request.Kind != track.Kind) {
+				continue
+			}
+			track.Muted = true
+			track.MutedBy = request.By
+			hub.broadcastMedia(EVENT_MEDIA_TRACK, name, *track)
+		}
+		sendMuteRequest(client, request)
+	}
+}
+
+func (hub *Hub) broadcastMedia(action string, name string, track MediaTrack) {
+	bts, err := jsoniter.Marshal(EventMediaTrack{
+		EventHead: &EventHead{
+			Id:     randomId(IdLength),
+			Action: action,
+			To:     TO_EVERYONE,
+		},
+		Payload: MediaTrackPayload{
+			Client: name,
+			Track:  track,
+		},
+	})
+	if err != nil {
+		log.Println("broadcastMedia", err)
+		return
+	}
+	for _, client := range hub.pool {
+		client.Send(bts)
+	}
+}
+
+//sendMediaState - gives just joined client snapshot of members tracks.
+func (hub *Hub) sendMediaState(c *Client) {
+	if len(hub.media.tracks) == 0 {
+		return
+	}
+	bts, err := jsoniter.Marshal(EventMediaState{
+		EventHead: &EventHead{
+			Id:     randomId(IdLength),
+			Action: EVENT_MEDIA_STATE,
+			To:     c.Name,
+		},
+		Payload: MediaStatePayload{
+			Media: hub.mediaSnapshot(),
+		},
+	})
+	if err != nil {
+		log.Println("sendMediaState", err)
+		return
+	}
+	c.Send(bts)
+}
+
+//Media - returns tracks of hub members.
+func (hub *Hub) Media() map[string][]MediaTrack {
+	result := make(chan map[string][]MediaTrack)
+	hub.listener <- commandData{
+		action: media,
+		media:  result,
+	}
+	return <-result
+}
+
+func consumeMediaTrack(c *Client, event Event) {
+	var track MediaTrack
+	if event.Payload != nil {
+		if err := jsoniter.Unmarshal(*event.Payload, &track); err != nil {
+			log.Println("consumeMediaTrack", err)
+		}
+	}
+	if c.Hub.isViewer(c.Name) {
+		notPublisher(c, c.Hub.ID, event.Id)
+		return
+	}
+	if track.Id == "" || (track.Kind != "audio" && track.Kind != "video") {
+		sendError(c, event.Id, ERROR_INVALID_TRACK, "Track must have id and audio or video kind")
+		return
+	}
+	c.Hub.listener <- commandData{
+		action: mediaUpdate,
+		key:    c.Name,
+		track:  &track,
+	}
+	confirmAction(c, event.Id)
+}
+
+func consumeMediaTrackRemoved(c *Client, event Event) {
+	var track MediaTrack
+	if event.Payload != nil {
+		if err := jsoniter.Unmarshal(*event.Payload, &track); err != nil {
+			log.Println("consumeMediaTrackRemoved", err)
+		}
+	}
+	c.Hub.listener <- commandData{
+		action: mediaRemove,
+		key:    c.Name,
+		peer:   track.Id,
+	}
+	confirmAction(c, event.Id)
+}
+
+func consumeMuteRequest(c *Client, event Event) {
+	var payload MuteRequestPayload
+	if event.Payload != nil {
+		if err := jsoniter.Unmarshal(*event.Payload, &payload); err != nil {
+			log.Println("consumeMuteRequest", err)
+		}
+	}
+	if !c.Hub.IsOwner(c.Name) {
+		notHubOwner(c, c.Hub.ID, event.Id)
+		return
+	}
+	if payload.Name != TO_EVERYONE && c.Hub.Get(payload.Name) == nil {
+		clientNotFound(c, payload.Name, event.Id)
+		return
+	}
+	payload.By = c.Name
+	c.Hub.listener <- commandData{
+		action: mediaMute,
+		mute:   &payload,
+	}
+	log.Printf("Client %s asked to mute %s in hub %s", c.Name, payload.Name, c.Hub.ID)
+	confirmAction(c, event.Id)
+}
+
+func sendMuteRequest(c *Client, request MuteRequestPayload) {
+	bts, err := jsoniter.Marshal(EventMuteRequest{
+		EventHead: &EventHead{
+			Id:     randomId(IdLength),
+			Action: EVENT_MUTE_REQUEST,
+			To:     c.Name,
+		},
+		Payload: request,
+	})
+	if err != nil {
+		log.Println("sendMuteRequest", err)
+		return
+	}
+	c.Send(bts)
+}
@@ -0,0 +1,181 @@
+package room
+
+import (
+	"fmt"
+	"github.com/json-iterator/go"
+	"log"
+	"sort"
+)
+
+const (
+	EVENT_MESH_PLAN      = "EVENT_MESH_PLAN"
+	EVENT_MESH_CONNECTED = "EVENT_MESH_CONNECTED"
+	EVENT_MESH_COMPLETE  = "EVENT_MESH_COMPLETE"
+
+	MESH_INITIATOR_NEWCOMER = "newcomer"
+	MESH_INITIATOR_MEMBERS  = "members"
+
+	DefaultMeshSize = 6
+	MaxMeshSize     = 16
+)
+
+type EventMeshPlan struct {
+	*EventHead
+	Payload MeshPlanPayload `json:"payload"`
+}
+
+type EventMeshComplete struct {
+	*EventHead
+	Payload MeshCompletePayload `json:"payload"`
+}
+
+type MeshPlanPayload struct {
+	Initiate []string `json:"initiate"`
+	Await    []string `json:"await"`
+}
+
+type MeshConnectedPayload struct {
+	Peer string `json:"peer"`
+}
+
+type MeshCompletePayload struct {
+	Peers []string `json:"peers"`
+}
+
+//meshState - pairwise connections of a mesh hub, confined to Hub.run.
+type meshState struct {
+	confirmed map[[2]string]map[string]bool
+	complete  bool
+}
+
+func newMeshState() *meshState {
+	return &meshState{
+		confirmed: make(map[[2]string]map[string]bool),
+	}
+}
+
+//meshJoin - plans offers between newcomer and members of the mesh.
+func (hub *Hub) meshJoin(newcomer *Client) {
+	var members []*Client
+	for name, client := range hub.pool {
+		if name != newcomer.Name {
+			members = append(members, client)
+		}
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].Name < members[j].Name
+	})
+	names := make([]string, 0, len(members))
+	for _, member := range members {
+		names = append(names, member.Name)
+	}
+	newcomerPlan := MeshPlanPayload{Initiate: []string{}, Await: []string{}}
+	memberPlan := MeshPlanPayload{Initiate: []string{}, Await: []string{}}
+	if hub.Options.MeshInitiator == MESH_INITIATOR_MEMBERS {
+		newcomerPlan.Await = names
+		memberPlan.Initiate = []string{newcomer.Name}
+	} else {
+		newcomerPlan.Initiate = names
+		memberPlan.Await = []string{newcomer.Name}
+	}
+	sendMeshPlan(newcomer, newcomerPlan)
+	for _, member := range members {
+		sendMeshPlan(member, memberPlan)
+	}
+	hub.mesh.complete = len(members) == 0
+}
+
+//meshConfirm - marks connection from reporter to peer as established.
+//Pair is connected when both sides have confirmed it.
+func (hub *Hub) meshConfirm(reporter string, peer string) {
+	if hub.pool[reporter] == nil || hub.pool[peer] == nil || reporter == peer {
+		return
+	}
+	key := pairKey(reporter, peer)
+	if hub.mesh.confirmed[key] == nil {
+		hub.mesh.confirmed[key] = make(map[string]bool)
+	}
+	hub.mesh.confirmed[key][reporter] = true
+	hub.meshCheck()
+}
+
+func (hub *Hub) meshLeave(name string) {
+	for key := range hub.mesh.confirmed {
+		if key[0] == name || key[1] == name {
+			delete(hub.mesh.confirmed, key)
+		}
+	}
+	hub.meshCheck()
+}
+
+func (hub *Hub) meshCheck() {
+	names := make([]string, 0, len(hub.pool))
+	for name := range hub.pool {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i := range names {
+		for j := i + 1; j < len(names); j++ {
+			if len(hub.mesh.confirmed[pairKey(names[i], names[j])]) < 2 {
+				hub.mesh.complete = false
+				return
+			}
+		}
+	}
+	if hub.mesh.complete || len(names) < 2 {
+		return
+	}
+	hub.mesh.complete = true
+	bts, err := jsoniter.Marshal(EventMeshComplete{
+		EventHead: &EventHead{
+			Id:     randomId(IdLength),
+			Action: EVENT_MESH_COMPLETE,
+			To:     TO_EVERYONE,
+		},
+		Payload: MeshCompletePayload{
+			Peers: names,
+		},
+	})
+	if err != nil {
+		log.Println("meshCheck", err)
+		return
+	}
+	for _, client := range hub.pool {
+		client.Send(bts)
+	}
+}
+
+func consumeMeshConnected(c *Client, event Event) {
+	var payload MeshConnectedPayload
+	if event.Payload != nil {
+		if err := jsoniter.Unmarshal(*event.Payload, &payload); err != nil {
+			log.Println("consumeMeshConnected", err)
+		}
+	}
+	if !c.Hub.Options.Mesh {
+		sendError(c, event.Id, ERROR_NOT_MESH, fmt.Sprintf("Hub %s is not in mesh mode", c.Hub.ID))
+		return
+	}
+	c.Hub.listener <- commandData{
+		action: meshConnected,
+		key:    c.Name,
+		peer:   payload.Peer,
+	}
+	confirmAction(c, event.Id)
+}
+
+func sendMeshPlan(c *Client, plan MeshPlanPayload) {
+	bts, err := jsoniter.Marshal(EventMeshPlan{
+		EventHead: &EventHead{
+			Id:     randomId(IdLength),
+			Action: EVENT_MESH_PLAN,
+			To:     c.Name,
+		},
+		Payload: plan,
+	})
+	if err != nil {
+		log.Println("sendMeshPlan", err)
+		return
+	}
+	c.Send(bts)
+}
@@ -0,0 +1,256 @@
+package room
+
+import (
+	"github.com/json-iterator/go"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	EVENT_NEGOTIATION_STATE     = "EVENT_NEGOTIATION_STATE"
+	EVENT_NEGOTIATION_COLLISION = "EVENT_NEGOTIATION_COLLISION"
+
+	NEGOTIATION_IDLE       = "idle"
+	NEGOTIATION_OFFER_SENT = "offer-sent"
+	NEGOTIATION_ANSWERED   = "answered"
+
+	NEGOTIATION_REASON_TIMEOUT   = "timeout"
+	NEGOTIATION_REASON_COLLISION = "collision"
+
+	NegotiationTimeout = time.Second * 15
+)
+
+type EventNegotiation struct {
+	*EventHead
+	Payload NegotiationPayload `json:"payload"`
+}
+
+type NegotiationPayload struct {
+	Peer    string `json:"peer"`
+	State   string `json:"state"`
+	Offerer string `json:"offerer,omitempty"`
+	Polite  bool   `json:"polite"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+//NegotiationInfo - state of offer/answer exchange between two peers.
+type NegotiationInfo struct {
+	Peers     [2]string `json:"peers"`
+	Polite    string    `json:"polite"`
+	State     string    `json:"state"`
+	Offerer   string    `json:"offerer,omitempty"`
+	UpdatedAt int64     `json:"updatedAt"`
+}
+
+type negotiation struct {
+	NegotiationInfo
+	generation int
+	timer      *time.Timer
+}
+
+//Negotiations - per peer pair negotiation registry used to resolve
+//glare. Peer with the lower name is polite: its colliding offer loses.
+type Negotiations struct {
+	mx    sync.Mutex
+	pairs map[[2]string]*negotiation
+}
+
+func NewNegotiations() *Negotiations {
+	return &Negotiations{
+		pairs: make(map[[2]string]*negotiation),
+	}
+}
+
+func pairKey(a, b string) [2]string {
+	key := [2]string{a, b}
+	sort.Strings(key[:])
+	return key
+}
+
+//IsPolite - reports whether peer a has polite role towards peer b.
+func IsPolite(a, b string) bool {
+	return a < b
+}
+
+//All - returns snapshot of all tracked negotiations.
+func (n *Negotiations) All() []NegotiationInfo {
+	n.mx.Lock()
+	defer n.mx.Unlock()
+	result := make([]NegotiationInfo, 0, len(n.pairs))
+	for _, neg := range n.pairs {
+		result = append(result, neg.NegotiationInfo)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Peers[0] != result[j].Peers[0] {
+			return result[i].Peers[0] < result[j].Peers[0]
+		}
+		return result[i].Peers[1] < result[j].Peers[1]
+	})
+	return result
+}
+
+func (n *Negotiations) get(a, b string) *negotiation {
+	key := pairKey(a, b)
+	neg := n.pairs[key]
+	if neg == nil {
+		neg = &negotiation{
+			NegotiationInfo: NegotiationInfo{
+				Peers:  key,
+				Polite: key[0],
+				State:  NEGOTIATION_IDLE,
+			},
+		}
+		n.pairs[key] = neg
+	}
+	return neg
+}
+
+//offer - registers offer from peer to peer. collision is true when
+//the other side has pending offer too, relay is false if the offer
+//loses the collision and has to be dropped.
+func (n *Negotiations) offer(from, to string, onTimeout func(NegotiationInfo)) (relay bool, collision bool) {
+	n.mx.Lock()
+	defer n.mx.Unlock()
+	neg := n.get(from, to)
+	if neg.State == NEGOTIATION_OFFER_SENT && neg.Offerer == to {
+		collision = true
+		if IsPolite(from, to) {
+			return false, collision
+		}
+	}
+	neg.State = NEGOTIATION_OFFER_SENT
+	neg.Offerer = from
+	neg.UpdatedAt = time.Now().Unix()
+	neg.generation++
+	if neg.timer != nil {
+		neg.timer.Stop()
+	}
+	key, generation := neg.Peers, neg.generation
+	neg.timer = time.AfterFunc(NegotiationTimeout, func() {
+		if info, ok := n.expire(key, generation); ok {
+			onTimeout(info)
+		}
+	})
+	return true, collision
+}
+
+//answer - registers answer, returns false if there was no pending
+//offer of the other side.
+func (n *Negotiations) answer(from, to string) bool {
+	n.mx.Lock()
+	defer n.mx.Unlock()
+	neg := n.pairs[pairKey(from, to)]
+	if neg == nil || neg.State != NEGOTIATION_OFFER_SENT || neg.Offerer != to {
+		return false
+	}
+	if neg.timer != nil {
+		neg.timer.Stop()
+	}
+	neg.State = NEGOTIATION_ANSWERED
+	neg.UpdatedAt = time.Now().Unix()
+	return true
+}
+
+func (n *Negotiations) expire(key [2]string, generation int) (NegotiationInfo, bool) {
+	n.mx.Lock()
+	defer n.mx.Unlock()
+	neg := n.pairs[key]
+	if neg == nil || neg.generation != generation || neg.State != NEGOTIATION_OFFER_SENT {
+		return NegotiationInfo{}, false
+	}
+	neg.State = NEGOTIATION_IDLE
+	neg.UpdatedAt = time.Now().Unix()
+	return neg.NegotiationInfo, true
+}
+
+//drop - forgets all negotiations of the disconnected peer.
+func (n *Negotiations) drop(name string) {
+	n.mx.Lock()
+	defer n.mx.Unlock()
+	for key, neg := range n.pairs {
+		if key[0] == name || key[1] == name {
+			if neg.timer != nil {
+				neg.timer.Stop()
+			}
+			delete(n.pairs, key)
+		}
+	}
+}
+
+func (n *Negotiations) info(a, b string) NegotiationInfo {
+	n.mx.Lock()
+	defer n.mx.Unlock()
+	return n.get(a, b).NegotiationInfo
+}
+
+//trackNegotiation - updates negotiation state of the pair on relayed
+//offer or answer, returns false if the event must not be relayed.
+func trackNegotiation(c *Client, addressee *Client, event Event) bool {
+	cluster := c.Hub.cluster
+	switch event.Action {
+	case EVENT_OFFER_CONNECTION:
+		relay, collision := cluster.negotiations.offer(c.Name, addressee.Name, func(info NegotiationInfo) {
+			notifyNegotiationState(cluster, info, NEGOTIATION_REASON_TIMEOUT)
+		})
+		if collision {
+			// polite side always loses the collision and has to roll back
+			loser := addressee
+			if !relay {
+				loser = c
+			}
+			emitNegotiationCollision(loser, event.Id, cluster.negotiations.info(c.Name, addressee.Name))
+		}
+		if relay {
+			notifyNegotiationState(cluster, cluster.negotiations.info(c.Name, addressee.Name), "")
+		}
+		return relay
+	case EVENT_ANSWER_CONNECTION:
+		if cluster.negotiations.answer(c.Name, addressee.Name) {
+			notifyNegotiationState(cluster, cluster.negotiations.info(c.Name, addressee.Name), "")
+		}
+	}
+	return true
+}
+
+func notifyNegotiationState(cluster *Cluster, info NegotiationInfo, reason string) {
+	id := randomId(IdLength)
+	for i, name := range info.Peers {
+		c := cluster.FindClient(name)
+		if c == nil {
+			continue
+		}
+		sendNegotiationEvent(c, id, EVENT_NEGOTIATION_STATE, info, info.Peers[1-i], reason)
+	}
+}
+
+func emitNegotiationCollision(c *Client, id string, info NegotiationInfo) {
+	peer := info.Peers[0]
+	if peer == c.Name {
+		peer = info.Peers[1]
+	}
+	sendNegotiationEvent(c, id, EVENT_NEGOTIATION_COLLISION, info, peer, NEGOTIATION_REASON_COLLISION)
+}
+
+func sendNegotiationEvent(c *Client, id string, action string, info NegotiationInfo, peer string, reason string) {
+	bts, err := jsoniter.Marshal(EventNegotiation{
+		EventHead: &EventHead{
+			Id:     id,
+			Action: action,
+			To:     c.Name,
+		},
+		Payload: NegotiationPayload{
+			Peer:    peer,
+			State:   info.State,
+			Offerer: info.Offerer,
+			Polite:  info.Polite == c.Name,
+			Reason:  reason,
+		},
+	})
+	if err != nil {
+		log.Println("sendNegotiationEvent", err)
+		return
+	}
+	c.Send(bts)
+}
@@ -0,0 +1,364 @@
+package room
+
+import (
+	"fmt"
+	"github.com/json-iterator/go"
+	"github.com/pion/sdp/v3"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	PolicyAuditSize = 1000
+)
+
+//MediaPolicy - restrictions applied to relayed offers, answers and
+//ICE candidates.
+type MediaPolicy struct {
+	AllowedCodecs    []string `json:"allowedCodecs,omitempty"`
+	DisallowedCodecs []string `json:"disallowedCodecs,omitempty"`
+	MaxAudioBitrate  int      `json:"maxAudioBitrate,omitempty"`
+	MaxVideoBitrate  int      `json:"maxVideoBitrate,omitempty"`
+	RelayOnly        bool     `json:"relayOnly,omitempty"`
+	BlockPrivateIPs  bool     `json:"blockPrivateIPs,omitempty"`
+	BlockMDNS        bool     `json:"blockMDNS,omitempty"`
+}
+
+//PolicyConfig - media policies by hub name and by client role.
+//Hub policy has priority over role policy, default applies otherwise.
+type PolicyConfig struct {
+	Default *MediaPolicy            `json:"default,omitempty"`
+	Hubs    map[string]*MediaPolicy `json:"hubs,omitempty"`
+	Roles   map[string]*MediaPolicy `json:"roles,omitempty"`
+}
+
+//PolicyAuditRecord - original and rewritten payload of relayed event.
+type PolicyAuditRecord struct {
+	From      string   `json:"from"`
+	To        string   `json:"to"`
+	Hub       string   `json:"hub"`
+	Action    string   `json:"action"`
+	At        int64    `json:"at"`
+	Changes   []string `json:"changes"`
+	Original  string   `json:"original"`
+	Rewritten string   `json:"rewritten,omitempty"`
+}
+
+//Policies - active policy config and bounded audit log of rewrites.
+type Policies struct {
+	mx     sync.RWMutex
+	config PolicyConfig
+	audit  []PolicyAuditRecord
+}
+
+func NewPolicies() *Policies {
+	return &Policies{}
+}
+
+//LoadPolicyConfig - reads policy config from JSON file.
+func LoadPolicyConfig(path string) (PolicyConfig, error) {
+	var config PolicyConfig
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	err = jsoniter.Unmarshal(data, &config)
+	return config, err
+}
+
+func (p *Policies) Set(config PolicyConfig) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	p.config = config
+}
+
+func (p *Policies) Audit() []PolicyAuditRecord {
+	p.mx.RLock()
+	defer p.mx.RUnlock()
+	result := make([]PolicyAuditRecord, len(p.audit))
+	copy(result, p.audit)
+	return result
+}
+
+func (p *Policies) record(record PolicyAuditRecord) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	if len(p.audit) >= PolicyAuditSize {
+		p.audit = p.audit[1:]
+	}
+	p.audit = append(p.audit, record)
+}
+
+//resolve - returns policy of the client with the role in the hub.
+func (p *Policies) resolve(hubID string, role string) *MediaPolicy {
+	p.mx.RLock()
+	defer p.mx.RUnlock()
+	if policy := p.config.Hubs[hubID]; policy != nil {
+		return policy
+	}
+	if policy := p.config.Roles[role]; policy != nil {
+		return policy
+	}
+	return p.config.Default
+}
+
+func (policy *MediaPolicy) codecAllowed(name string) bool {
+	for _, codec := range policy.DisallowedCodecs {
+		if strings.EqualFold(codec, name) {
+			return false
+		}
+	}
+	if len(policy.AllowedCodecs) == 0 || strings.EqualFold(name, "rtx") ||
+		strings.EqualFold(name, "red") || strings.EqualFold(name, "ulpfec") {
+		return true
+	}
+	for _, codec := range policy.AllowedCodecs {
+		if strings.EqualFold(codec, name) {
+			return true
+		}
+	}
+	return false
+}
+
+//candidateAllowed - checks "candidate:..." line, returns reason
+//if the candidate is filtered out.
+func (policy *MediaPolicy) candidateAllowed(candidate string) (bool, string) {
+	fields := strings.Fields(strings.TrimPrefix(candidate, "a="))
+	if len(fields) < 8 {
+		return false, "removed malformed candidate"
+	}
+	address, typ := fields[4], fields[7]
+	if policy.RelayOnly && typ != "relay" {
+		return false, fmt.Sprintf("removed %s candidate %s", typ, address)
+	}
+	if policy.BlockMDNS && strings.HasSuffix(address, ".local") {
+		return false, fmt.Sprintf("removed mDNS candidate %s", address)
+	}
+	if policy.BlockPrivateIPs {
+		if ip := net.ParseIP(address); ip != nil && isPrivateIP(ip) {
+			return false, fmt.Sprintf("removed private candidate %s", address)
+		}
+	}
+	return true, ""
+}
+
+func isPrivateIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+		return true
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4[0] == 10 ||
+			(ip4[0] == 172 && ip4[1]&0xf0 == 16) ||
+			(ip4[0] == 192 && ip4[1] == 168) ||
+			(ip4[0] == 100 && ip4[1]&0xc0 == 64)
+	}
+	return ip[0]&0xfe == 0xfc
+}
+
+//rewriteSDP - applies policy to session description, returns list
+//of performed changes.
+func (policy *MediaPolicy) rewriteSDP(desc *sdp.SessionDescription) []string {
+	var changes []string
+	for _, media := range desc.MediaDescriptions {
+		changes = append(changes, policy.filterCodecs(media)...)
+		limit := 0
+		switch media.MediaName.Media {
+		case "audio":
+			limit = policy.MaxAudioBitrate
+		case "video":
+			limit = policy.MaxVideoBitrate
+		}
+		if limit > 0 && capBandwidth(media, uint64(limit)) {
+			changes = append(changes, fmt.Sprintf("capped %s bandwidth to %d kbps", media.MediaName.Media, limit))
+		}
+		attributes := media.Attributes[:0]
+		for _, attr := range media.Attributes {
+			if attr.IsICECandidate() {
+				if ok, reason := policy.candidateAllowed(attr.Value); !ok {
+					changes = append(changes, reason)
+					continue
+				}
+			}
+			attributes = append(attributes, attr)
+		}
+		media.Attributes = attributes
+	}
+	return changes
+}
+
+//filterCodecs - removes payload types of disallowed codecs together
+//with their retransmission payloads and attributes.
+func (policy *MediaPolicy) filterCodecs(media *sdp.MediaDescription) []string {
+	var changes []string
+	removed := make(map[string]bool)
+	for _, attr := range media.Attributes {
+		if attr.Key != "rtpmap" {
+			continue
+		}
+		parts := strings.SplitN(attr.Value, " ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		name := strings.SplitN(parts[1], "/", 2)[0]
+		if !policy.codecAllowed(name) {
+			removed[parts[0]] = true
+			changes = append(changes, fmt.Sprintf("removed codec %s from %s", parts[1], media.MediaName.Media))
+		}
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+	// retransmission payloads point to the removed ones with apt parameter
+	for _, attr := range media.Attributes {
+		if attr.Key != "fmtp" {
+			continue
+		}
+		parts := strings.SplitN(attr.Value, " ", 2)
+		if len(parts) == 2 && strings.HasPrefix(parts[1], "apt=") && removed[strings.TrimPrefix(parts[1], "apt=")] {
+			removed[parts[0]] = true
+		}
+	}
+	formats := make([]string, 0, len(media.MediaName.Formats))
+	for _, format := range media.MediaName.Formats {
+		if !removed[format] {
+			formats = append(formats, format)
+		}
+	}
+	if len(formats) == 0 {
+		// no codec left, the section is rejected
+		media.MediaName.Port.Value = 0
+		return changes
+	}
+	media.MediaName.Formats = formats
+	attributes := media.Attributes[:0]
+	for _, attr := range media.Attributes {
+		switch attr.Key {
+		case "rtpmap", "fmtp", "rtcp-fb":
+			if removed[strings.SplitN(attr.Value, " ", 2)[0]] {
+				continue
+			}
+		}
+		attributes = append(attributes, attr)
+	}
+	media.Attributes = attributes
+	return changes
+}
+
+func capBandwidth(media *sdp.MediaDescription, limit uint64) bool {
+	for i, b := range media.Bandwidth {
+		if b.Type == "AS" {
+			if b.Bandwidth <= limit {
+				return false
+			}
+			media.Bandwidth[i].Bandwidth = limit
+			return true
+		}
+	}
+	media.Bandwidth = append(media.Bandwidth, sdp.Bandwidth{Type: "AS", Bandwidth: limit})
+	return true
+}
+
+//findCandidate - looks for RTCIceCandidateInit like object in decoded
+//event payload, the candidate line may have "a=" prefix. Empty candidate
+//marks end of candidates.
+func findCandidate(v interface{}) map[string]interface{} {
+	node, ok := v.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	if candidate, ok := node["candidate"].(string); ok {
+		line := strings.TrimPrefix(candidate, "a=")
+		if line == "" || strings.HasPrefix(line, "candidate:") {
+			return node
+		}
+	}
+	return findCandidate(node["candidate"])
+}
+
+//enforcePolicy - rewrites relayed offer, answer or candidate according
+//to media policy of the sender, returns false if the event is dropped.
+//Payload which can't be inspected is dropped, so the policy can't be
+//bypassed by its shape.
+func enforcePolicy(c *Client, addressee *Client, event *Event) bool {
+	policies := c.Hub.cluster.policies
+	policy := policies.resolve(c.Hub.ID, c.Hub.RoleOf(c.Name))
+	if policy == nil || event.Payload == nil {
+		return true
+	}
+	record := PolicyAuditRecord{
+		From:     c.Name,
+		To:       addressee.Name,
+		Hub:      c.Hub.ID,
+		Action:   event.Action,
+		At:       time.Now().Unix(),
+		Original: string(*event.Payload),
+	}
+	var payload interface{}
+	if err := jsoniter.Unmarshal(*event.Payload, &payload); err != nil {
+		return rejectByPolicy(c, event, record, "payload is not valid JSON")
+	}
+	if event.Action == EVENT_CANDIDATE_CONNECTION {
+		node := findCandidate(payload)
+		if node == nil {
+			return rejectByPolicy(c, event, record, "candidate not found in payload")
+		}
+		candidate := strings.TrimPrefix(node["candidate"].(string), "a=")
+		if candidate == "" {
+			return true
+		}
+		if ok, reason := policy.candidateAllowed(candidate); !ok {
+			record.Changes = []string{reason}
+			policies.record(record)
+			return false
+		}
+		return true
+	}
+	node := findDescription(payload)
+	if node == nil {
+		return rejectByPolicy(c, event, record, "session description not found in payload")
+	}
+	desc, _, err := ParseSDP(node["sdp"].(string))
+	if err != nil {
+		return rejectByPolicy(c, event, record, "session description can't be parsed: "+err.Error())
+	}
+	record.Changes = policy.rewriteSDP(desc)
+	if len(record.Changes) == 0 {
+		return true
+	}
+	rewritten, err := desc.Marshal()
+	if err != nil {
+		log.Println("enforcePolicy", err)
+		return rejectByPolicy(c, event, record, "session description can't be rewritten")
+	}
+	node["sdp"] = string(rewritten)
+	bts, err := jsoniter.Marshal(payload)
+	if err != nil {
+		log.Println("enforcePolicy", err)
+		return rejectByPolicy(c, event, record, "payload can't be rewritten")
+	}
+	raw := jsoniter.RawMessage(bts)
+	event.Payload = &raw
+	record.Rewritten = string(bts)
+	policies.record(record)
+	log.Printf("Policy rewrote %s from %s to %s: %s", event.Action, c.Name, addressee.Name,
+		strings.Join(record.Changes, ", "))
+	return true
+}
+
+//rejectByPolicy - drops event which can't be checked against the policy,
+//records the drop and tells the sender about it.
+func rejectByPolicy(c *Client, event *Event, record PolicyAuditRecord, reason string) bool {
+	record.Changes = []string{"dropped, " + reason}
+	c.Hub.cluster.policies.record(record)
+	log.Printf("Policy dropped %s from %s to %s: %s", event.Action, c.Name, record.To, reason)
+	code := ERROR_INVALID_SDP
+	if event.Action == EVENT_CANDIDATE_CONNECTION {
+		code = ERROR_CANDIDATE_DROPPED
+	}
+	sendError(c, event.Id, code, fmt.Sprintf("Event %s dropped by media policy: %s", event.Action, reason))
+	return false
+}
@@ -0,0 +1,301 @@
+package room
+
+import (
+	"github.com/json-iterator/go"
+	"log"
+	"time"
+)
+
+const (
+	EVENT_HAND_RAISE    = "EVENT_HAND_RAISE"
+	EVENT_HAND_LOWER    = "EVENT_HAND_LOWER"
+	EVENT_FLOOR_GRANT   = "EVENT_FLOOR_GRANT"
+	EVENT_SPEAKER_QUEUE = "EVENT_SPEAKER_QUEUE"
+
+	QueueReconnectGrace = time.Second * 30
+)
+
+type EventSpeakerQueue struct {
+	*EventHead
+	Payload SpeakerQueuePayload `json:"payload"`
+}
+
+//QueueEntry - raised hand, Away is set while its member reconnects.
+type QueueEntry struct {
+	Name     string `json:"name"`
+	RaisedAt int64  `json:"raisedAt"`
+	Away     bool   `json:"away,omitempty"`
+}
+
+//SpeakerQueuePayload - raised hands in order and member having the floor.
+type SpeakerQueuePayload struct {
+	Queue []QueueEntry `json:"queue"`
+	Floor string       `json:"floor,omitempty"`
+}
+
+//HandPayload - member whose hand is lowered or who gets the floor,
+//empty name means the sender or the first in the queue.
+type HandPayload struct {
+	Name string `json:"name,omitempty"`
+}
+
+type queueEntry struct {
+	name      string
+	raisedAt  time.Time
+	awaySince time.Time
+}
+
+//queueState - speaker queue, owned by the hub goroutine. Entries of
+//disconnected members are kept for QueueReconnectGrace.
+type queueState struct {
+	entries   []*queueEntry
+	floor     string
+	floorAway time.Time
+}
+
+func newQueueState() *queueState {
+	return &queueState{}
+}
+
+func (q *queueState) index(name string) int {
+	for i, entry := range q.entries {
+		if entry.name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func (q *queueState) remove(name string) bool {
+	i := q.index(name)
+	if i < 0 {
+		return false
+	}
+	q.entries = append(q.entries[:i], q.entries[i+1:]...)
+	return true
+}
+
+//prune - drops entries and floor of members which didn't reconnect in
+//time, returns true if anything was dropped.
+func (q *queueState) prune(now time.Time) bool {
+	pruned := false
+	entries := q.entries[:0]
+	for _, entry := range q.entries {
+		if !entry.awaySince.IsZero() && now.Sub(entry.awaySince) > QueueReconnectGrace {
+			pruned = true
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	q.entries = entries
+	if q.floor != "" && !q.floorAway.IsZero() && now.Sub(q.floorAway) > QueueReconnectGrace {
+		q.floor = ""
+		q.floorAway = time.Time{}
+		pruned = true
+	}
+	return pruned
+}
+
+func (hub *Hub) queueRaise(name string) {
+	q := hub.queue
+	q.prune(time.Now())
+	if q.floor == name || q.index(name) >= 0 {
+		return
+	}
+	q.entries = append(q.entries, &queueEntry{
+		name:     name,
+		raisedAt: time.Now(),
+	})
+	hub.broadcastQueue()
+}
+
+//queueLower - removes the hand, member having the floor gives it up
+//by lowering the hand.
+func (hub *Hub) queueLower(name string) {
+	q := hub.queue
+	changed := q.prune(time.Now())
+	if q.remove(name) {
+		changed = true
+	}
+	if q.floor == name {
+		q.floor = ""
+		q.floorAway = time.Time{}
+		changed = true
+	}
+	if changed {
+		hub.broadcastQueue()
+	}
+}
+
+//queueGrant - gives the floor to the member or to the first present
+//member in the queue, floor is released if the queue is empty.
+func (hub *Hub) queueGrant(name string) {
+	q := hub.queue
+	q.prune(time.Now())
+	if name == "" {
+		for _, entry := range q.entries {
+			if entry.awaySince.IsZero() {
+				name = entry.name
+				break
+			}
+		}
+	}
+	q.remove(name)
+	q.floor = name
+	q.floorAway = time.Time{}
+	hub.broadcastQueue()
+}
+
+//queueJoin - restores entries of reconnected member.
+func (hub *Hub) queueJoin(c *Client) {
+	q := hub.queue
+	changed := q.prune(time.Now())
+	if i := q.index(c.Name); i >= 0 {
+		q.entries[i].awaySince = time.Time{}
+		changed = true
+	}
+	if q.floor == c.Name && !q.floorAway.IsZero() {
+		q.floorAway = time.Time{}
+		changed = true
+	}
+	if changed {
+		hub.broadcastQueue()
+	} else if len(q.entries) > 0 || q.floor != "" {
+		hub.sendQueue(c)
+	}
+}
+
+//queueLeave - clears entries of member which left the hub, entries of
+//disconnected member wait for its reconnect.
+func (hub *Hub) queueLeave(name string, disconnected bool) {
+	q := hub.queue
+	now := time.Now()
+	changed := q.prune(now)
+	if !disconnected {
+		if q.remove(name) {
+			changed = true
+		}
+		if q.floor == name {
+			q.floor = ""
+			q.floorAway = time.Time{}
+			changed = true
+		}
+	} else {
+		if i := q.index(name); i >= 0 {
+			q.entries[i].awaySince = now
+			changed = true
+		}
+		if q.floor == name {
+			q.floorAway = now
+			changed = true
+		}
+	}
+	if changed {
+		hub.broadcastQueue()
+	}
+}
+
+//queueRoleChanged - resends queue after stage role change, since it
+//changes hands and floor visible to viewers.
+func (hub *Hub) queueRoleChanged() {
+	if len(hub.queue.entries) > 0 || hub.queue.floor != "" {
+		hub.broadcastQueue()
+	}
+}
+
+func (hub *Hub) queuePayload(to string) SpeakerQueuePayload {
+	q := hub.queue
+	payload := SpeakerQueuePayload{
+		Queue: make([]QueueEntry, 0, len(q.entries)),
+	}
+	if hub.visible(to, q.floor) {
+		payload.Floor = q.floor
+	}
+	for _, entry := range q.entries {
+		if !hub.visible(to, entry.name) {
+			continue
+		}
+		payload.Queue = append(payload.Queue, QueueEntry{
+			Name:     entry.name,
+			RaisedAt: entry.raisedAt.Unix(),
+			Away:     !entry.awaySince.IsZero(),
+		})
+	}
+	return payload
+}
+
+//broadcastQueue - sends queue to every member, viewers of stage hub
+//don't see hands of other viewers.
+func (hub *Hub) broadcastQueue() {
+	for _, client := range hub.pool {
+		hub.sendQueue(client)
+	}
+}
+
+func (hub *Hub) sendQueue(c *Client) {
+	bts, err := jsoniter.Marshal(EventSpeakerQueue{
+		EventHead: &EventHead{
+			Id:     randomId(IdLength),
+			Action: EVENT_SPEAKER_QUEUE,
+			To:     c.Name,
+		},
+		Payload: hub.queuePayload(c.Name),
+	})
+	if err != nil {
+		log.Println("sendQueue", err)
+		return
+	}
+	c.Send(bts)
+}
+
+func consumeHandRaise(c *Client, event Event) {
+	c.Hub.listener <- commandData{
+		action: handRaise,
+		key:    c.Name,
+	}
+	confirmAction(c, event.Id)
+}
+
+func consumeHandLower(c *Client, event Event) {
+	var payload HandPayload
+	if event.Payload != nil {
+		if err := jsoniter.Unmarshal(*event.Payload, &payload); err != nil {
+			log.Println("consumeHandLower", err)
+		}
+	}
+	if payload.Name == "" {
+		payload.Name = c.Name
+	}
+	if payload.Name != c.Name && !c.Hub.IsOwner(c.Name) {
+		notHubOwner(c, c.Hub.ID, event.Id)
+		return
+	}
+	c.Hub.listener <- commandData{
+		action: handLower,
+		key:    payload.Name,
+	}
+	confirmAction(c, event.Id)
+}
+
+func consumeFloorGrant(c *Client, event Event) {
+	var payload HandPayload
+	if event.Payload != nil {
+		if err := jsoniter.Unmarshal(*event.Payload, &payload); err != nil {
+			log.Println("consumeFloorGrant", err)
+		}
+	}
+	if !c.Hub.IsOwner(c.Name) {
+		notHubOwner(c, c.Hub.ID, event.Id)
+		return
+	}
+	if payload.Name != "" && c.Hub.Get(payload.Name) == nil {
+		clientNotFound(c, payload.Name, event.Id)
+		return
+	}
+	c.Hub.listener <- commandData{
+		action: floorGrant,
+		key:    payload.Name,
+	}
+	log.Printf("Client %s granted floor in hub %s", c.Name, c.Hub.ID)
+	confirmAction(c, event.Id)
+}
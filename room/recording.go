@@ -0,0 +1,359 @@
+package room
+
+import (
+	"fmt"
+	"github.com/json-iterator/go"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media/h264writer"
+	"github.com/pion/webrtc/v4/pkg/media/ivfwriter"
+	"github.com/pion/webrtc/v4/pkg/media/oggwriter"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	EVENT_RECORDING_START   = "EVENT_RECORDING_START"
+	EVENT_RECORDING_STOP    = "EVENT_RECORDING_STOP"
+	EVENT_RECORDING_STATE   = "EVENT_RECORDING_STATE"
+	EVENT_RECORDING_CONSENT = "EVENT_RECORDING_CONSENT"
+
+	DefaultRecorderName = "recorder"
+)
+
+type EventRecordingState struct {
+	*EventHead
+	Payload RecordingPayload `json:"payload"`
+}
+
+//RecordingPayload - recording indicator of the hub. Members listed in
+//Consented publish their tracks to Recorder peer.
+type RecordingPayload struct {
+	Recording bool     `json:"recording"`
+	Id        string   `json:"id,omitempty"`
+	Recorder  string   `json:"recorder,omitempty"`
+	StartedBy string   `json:"startedBy,omitempty"`
+	StartedAt int64    `json:"startedAt,omitempty"`
+	Consented []string `json:"consented,omitempty"`
+}
+
+type RecordingConsentPayload struct {
+	Consent bool `json:"consent"`
+}
+
+type recording struct {
+	id        string
+	hub       string
+	dir       string
+	startedBy string
+	startedAt time.Time
+	consent   map[string]bool
+}
+
+//trackWriter - container file of single recorded track.
+type trackWriter interface {
+	WriteRTP(packet *rtp.Packet) error
+	Close() error
+}
+
+//Recorder - records tracks of consenting hub members to files in Dir,
+//one directory per recording.
+type Recorder struct {
+	Dir        string
+	bot        *Bot
+	mx         sync.Mutex
+	recordings map[string]*recording
+}
+
+//NewRecorder - creates peer receiving tracks of the recorded hubs.
+func NewRecorder(name string, dir string, cluster *Cluster) (*Recorder, error) {
+	if name == "" {
+		name = DefaultRecorderName
+	}
+	api, err := newMediaAPI()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	r := &Recorder{
+		Dir:        dir,
+		recordings: make(map[string]*recording),
+	}
+	r.bot = NewBot(name, cluster)
+	r.bot.api = api
+	r.bot.hooks = botHooks{
+		admit: r.admit,
+		track: r.record,
+	}
+	return r, nil
+}
+
+//admit - accepts offers only from consenting members of recorded hub.
+func (r *Recorder) admit(c *Client) error {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	rec := r.recordings[c.Hub.ID]
+	if rec == nil {
+		return &botError{ERROR_RECORDING_STATE, fmt.Sprintf("Hub %s is not recorded", c.Hub.ID)}
+	}
+	if !rec.consent[c.Name] {
+		return &botError{ERROR_CONSENT_REQUIRED, "Recording consent is required"}
+	}
+	return nil
+}
+
+func (r *Recorder) start(hub *Hub, by string) (*recording, error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	if r.recordings[hub.ID] != nil {
+		return nil, fmt.Errorf("Hub %s is already recorded", hub.ID)
+	}
+	rec := &recording{
+		id:        randomId(IdLength),
+		hub:       hub.ID,
+		startedBy: by,
+		startedAt: time.Now(),
+		consent:   make(map[string]bool),
+	}
+	dir, err := joinUnder(r.Dir, hub.ID, rec.startedAt.Format("20060102-150405")+"-"+rec.id)
+	if err != nil {
+		return nil, err
+	}
+	rec.dir = dir
+	if err := os.MkdirAll(rec.dir, 0755); err != nil {
+		return nil, err
+	}
+	r.recordings[hub.ID] = rec
+	return rec, nil
+}
+
+//stop - ends recording of the hub and disconnects its members from the
+//recorder, files are closed when their tracks end.
+func (r *Recorder) stop(hubID string) bool {
+	r.mx.Lock()
+	rec := r.recordings[hubID]
+	delete(r.recordings, hubID)
+	r.mx.Unlock()
+	if rec == nil {
+		return false
+	}
+	for _, peer := range r.bot.Peers(hubID) {
+		peer.Close()
+	}
+	log.Printf("Recording %s of hub %s stopped", rec.id, hubID)
+	return true
+}
+
+//setConsent - records decision of the member, returns false if the
+//hub isn't recorded.
+func (r *Recorder) setConsent(hubID string, name string, consent bool) bool {
+	r.mx.Lock()
+	rec := r.recordings[hubID]
+	if rec != nil {
+		rec.consent[name] = consent
+	}
+	r.mx.Unlock()
+	if rec != nil && !consent {
+		if peer := r.bot.Peer(name); peer != nil && peer.Hub == hubID {
+			peer.Close()
+		}
+	}
+	return rec != nil
+}
+
+func (r *Recorder) state(hubID string) RecordingPayload {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	rec := r.recordings[hubID]
+	if rec == nil {
+		return RecordingPayload{}
+	}
+	payload := RecordingPayload{
+		Recording: true,
+		Id:        rec.id,
+		Recorder:  r.bot.Name,
+		StartedBy: rec.startedBy,
+		StartedAt: rec.startedAt.Unix(),
+		Consented: []string{},
+	}
+	for name, consent := range rec.consent {
+		if consent {
+			payload.Consented = append(payload.Consented, name)
+		}
+	}
+	sort.Strings(payload.Consented)
+	return payload
+}
+
+//record - writes incoming track of the peer to container file
+//matching its codec until the track ends.
+func (r *Recorder) record(peer *BotPeer, remote *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+	r.mx.Lock()
+	rec := r.recordings[peer.Hub]
+	r.mx.Unlock()
+	if rec == nil {
+		return
+	}
+	codec := remote.Codec()
+	base, err := joinUnder(rec.dir, peer.Name+"-"+remote.ID())
+	if err != nil {
+		log.Printf("Recorder can't record track %s of %s: %s", remote.ID(), peer.Name, err)
+		return
+	}
+	var writer trackWriter
+	switch mime := strings.ToLower(codec.MimeType); mime {
+	case strings.ToLower(webrtc.MimeTypeOpus):
+		writer, err = oggwriter.New(base+".ogg", codec.ClockRate, codec.Channels)
+	case strings.ToLower(webrtc.MimeTypeVP8), strings.ToLower(webrtc.MimeTypeVP9), strings.ToLower(webrtc.MimeTypeAV1):
+		writer, err = ivfwriter.New(base+".ivf", ivfwriter.WithCodec(codec.MimeType))
+	case strings.ToLower(webrtc.MimeTypeH264):
+		writer, err = h264writer.New(base + ".h264")
+	default:
+		err = fmt.Errorf("codec %s is not supported", codec.MimeType)
+	}
+	if err != nil {
+		log.Printf("Recorder can't record track %s of %s: %s", remote.ID(), peer.Name, err)
+		return
+	}
+	log.Printf("Recorder writes %s track of %s to %s", codec.MimeType, peer.Name, rec.dir)
+	for {
+		packet, _, err := remote.ReadRTP()
+		if err != nil {
+			break
+		}
+		if err := writer.WriteRTP(packet); err != nil {
+			log.Printf("Recorder track %s of %s: %s", remote.ID(), peer.Name, err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		log.Printf("Recorder track %s of %s: %s", remote.ID(), peer.Name, err)
+	}
+}
+
+//safeFileName - replaces separators and control characters, names
+//referring to directories themselves are replaced too.
+func safeFileName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == os.PathSeparator || r < ' ' {
+			return '_'
+		}
+		return r
+	}, name)
+	if name == "" || name == "." || name == ".." {
+		return strings.Repeat("_", len(name)+1)
+	}
+	return name
+}
+
+//joinUnder - joins sanitized names to the directory, returns error if
+//the result doesn't stay inside it.
+func joinUnder(dir string, names ...string) (string, error) {
+	path := dir
+	for _, name := range names {
+		path = filepath.Join(path, safeFileName(name))
+	}
+	rel, err := filepath.Rel(dir, path)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("Path %s is outside of %s", path, dir)
+	}
+	return path, nil
+}
+
+func consumeRecordingStart(c *Client, event Event) {
+	recorder := c.Hub.cluster.recorder
+	if recorder == nil {
+		sendError(c, event.Id, ERROR_RECORDING_STATE, "Recording is disabled")
+		return
+	}
+	if !c.Hub.IsOwner(c.Name) {
+		notHubOwner(c, c.Hub.ID, event.Id)
+		return
+	}
+	rec, err := recorder.start(c.Hub, c.Name)
+	if err != nil {
+		sendError(c, event.Id, ERROR_RECORDING_STATE, err.Error())
+		return
+	}
+	log.Printf("Recording %s of hub %s started by %s", rec.id, c.Hub.ID, c.Name)
+	emitRecordingState(c.Hub.cluster, c.Hub.ID)
+	confirmAction(c, event.Id)
+}
+
+func consumeRecordingStop(c *Client, event Event) {
+	recorder := c.Hub.cluster.recorder
+	if recorder == nil {
+		sendError(c, event.Id, ERROR_RECORDING_STATE, "Recording is disabled")
+		return
+	}
+	if !c.Hub.IsOwner(c.Name) {
+		notHubOwner(c, c.Hub.ID, event.Id)
+		return
+	}
+	if !recorder.stop(c.Hub.ID) {
+		sendError(c, event.Id, ERROR_RECORDING_STATE, fmt.Sprintf("Hub %s is not recorded", c.Hub.ID))
+		return
+	}
+	emitRecordingState(c.Hub.cluster, c.Hub.ID)
+	confirmAction(c, event.Id)
+}
+
+func consumeRecordingConsent(c *Client, event Event) {
+	var payload RecordingConsentPayload
+	if event.Payload != nil {
+		if err := jsoniter.Unmarshal(*event.Payload, &payload); err != nil {
+			log.Println("consumeRecordingConsent", err)
+		}
+	}
+	recorder := c.Hub.cluster.recorder
+	if recorder == nil || !recorder.setConsent(c.Hub.ID, c.Name, payload.Consent) {
+		sendError(c, event.Id, ERROR_RECORDING_STATE, fmt.Sprintf("Hub %s is not recorded", c.Hub.ID))
+		return
+	}
+	emitRecordingState(c.Hub.cluster, c.Hub.ID)
+	confirmAction(c, event.Id)
+}
+
+func emitRecordingState(cluster *Cluster, hubID string) {
+	bts, err := recordingState(cluster, TO_EVERYONE, hubID)
+	if err != nil {
+		log.Println("emitRecordingState", err)
+		return
+	}
+	cluster.Emit(bts, hubID)
+}
+
+//sendRecordingState - tells client joining recorded hub about it.
+func sendRecordingState(c *Client) {
+	recorder := c.Hub.cluster.recorder
+	if recorder == nil {
+		return
+	}
+	state := recorder.state(c.Hub.ID)
+	if !state.Recording {
+		return
+	}
+	bts, err := recordingState(c.Hub.cluster, c.Name, c.Hub.ID)
+	if err != nil {
+		log.Println("sendRecordingState", err)
+		return
+	}
+	c.Send(bts)
+}
+
+func recordingState(cluster *Cluster, to string, hubID string) ([]byte, error) {
+	return jsoniter.Marshal(EventRecordingState{
+		EventHead: &EventHead{
+			Id:     randomId(IdLength),
+			Action: EVENT_RECORDING_STATE,
+			To:     to,
+		},
+		Payload: cluster.recorder.state(hubID),
+	})
+}
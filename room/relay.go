@@ -0,0 +1,327 @@
+package room
+
+import (
+	"expvar"
+	"fmt"
+	"github.com/json-iterator/go"
+	"github.com/lempiy/Signaller/nat"
+	"log"
+	"sync"
+)
+
+const (
+	EVENT_RELAY_OPEN  = "EVENT_RELAY_OPEN"
+	EVENT_RELAY_DATA  = "EVENT_RELAY_DATA"
+	EVENT_RELAY_CLOSE = "EVENT_RELAY_CLOSE"
+
+	DefaultMaxRelayStreams = 8
+)
+
+var relayMetrics = expvar.NewMap("relay")
+
+type EventRelay struct {
+	*EventHead
+	Payload RelayPayload `json:"payload"`
+}
+
+//RelayPayload - relay stream description, Data is used only by JSON
+//EVENT_RELAY_DATA for clients which can't send binary frames.
+type RelayPayload struct {
+	Stream string `json:"stream,omitempty"`
+	Peer   string `json:"peer,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	Data   []byte `json:"data,omitempty"`
+}
+
+//RelayConfig - limits of relayed streams. Bandwidth is bytes per second
+//a client may send through all its streams, zero means unlimited.
+type RelayConfig struct {
+	Bandwidth  int
+	MaxStreams int
+}
+
+type relayStream struct {
+	id    string
+	hub   string
+	peers [2]string
+}
+
+func (s *relayStream) peer(name string) string {
+	if s.peers[0] == name {
+		return s.peers[1]
+	}
+	return s.peers[0]
+}
+
+//Relays - data streams relayed through the server between clients
+//which can't establish peer-to-peer connection.
+type Relays struct {
+	mx      sync.Mutex
+	config  RelayConfig
+	streams map[string]*relayStream
+	buckets map[string]*nat.Bucket
+}
+
+func NewRelays() *Relays {
+	return &Relays{
+		config:  RelayConfig{MaxStreams: DefaultMaxRelayStreams},
+		streams: make(map[string]*relayStream),
+		buckets: make(map[string]*nat.Bucket),
+	}
+}
+
+func (r *Relays) Set(config RelayConfig) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	if config.MaxStreams <= 0 {
+		config.MaxStreams = DefaultMaxRelayStreams
+	}
+	r.config = config
+	r.buckets = make(map[string]*nat.Bucket)
+}
+
+func (r *Relays) count(name string) int {
+	count := 0
+	for _, s := range r.streams {
+		if s.peers[0] == name || s.peers[1] == name {
+			count++
+		}
+	}
+	return count
+}
+
+//open - creates stream between clients, returns nil if one of them
+//reached streams limit.
+func (r *Relays) open(hub string, from string, to string) *relayStream {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	if r.count(from) >= r.config.MaxStreams || r.count(to) >= r.config.MaxStreams {
+		return nil
+	}
+	s := &relayStream{
+		id:    randomId(IdLength),
+		hub:   hub,
+		peers: [2]string{from, to},
+	}
+	r.streams[s.id] = s
+	relayMetrics.Add("opened", 1)
+	relayMetrics.Add("active", 1)
+	return s
+}
+
+//get - returns stream if the client is its party.
+func (r *Relays) get(id string, name string) *relayStream {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	s := r.streams[id]
+	if s == nil || (s.peers[0] != name && s.peers[1] != name) {
+		return nil
+	}
+	return s
+}
+
+func (r *Relays) close(id string) *relayStream {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	s := r.streams[id]
+	if s != nil {
+		delete(r.streams, id)
+		relayMetrics.Add("active", -1)
+	}
+	return s
+}
+
+//drop - closes streams of the disconnected client, returns them.
+func (r *Relays) drop(name string) []*relayStream {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	var dropped []*relayStream
+	for id, s := range r.streams {
+		if s.peers[0] == name || s.peers[1] == name {
+			delete(r.streams, id)
+			relayMetrics.Add("active", -1)
+			dropped = append(dropped, s)
+		}
+	}
+	delete(r.buckets, name)
+	return dropped
+}
+
+func (r *Relays) bucket(name string) *nat.Bucket {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	b := r.buckets[name]
+	if b == nil {
+		b = nat.NewBucket(r.config.Bandwidth)
+		r.buckets[name] = b
+	}
+	return b
+}
+
+//allow - takes n bytes from budget of the client. Relayed data is read
+//by the websocket reader of the client, so data over budget isn't waited
+//for, the sender is told to resend it after the delay instead.
+func (r *Relays) allow(c *Client, s *relayStream, id string, n int) bool {
+	b := r.bucket(c.Name)
+	if !b.Fits(n) {
+		relayMetrics.Add("dropped", 1)
+		sendError(c, id, ERROR_RELAY_LIMIT,
+			fmt.Sprintf("Relay data of %d bytes for stream %s exceeds bandwidth limit", n, s.id))
+		return false
+	}
+	if !b.Allow(n) {
+		relayMetrics.Add("throttled", 1)
+		sendError(c, id, ERROR_RELAY_LIMIT,
+			fmt.Sprintf("Relay data of %d bytes for stream %s dropped, resend in %d ms",
+				n, s.id, b.Delay(n).Milliseconds()))
+		return false
+	}
+	return true
+}
+
+//ConsumeRelayFrame - relays binary websocket frame, the first IdLength
+//bytes of the frame are id of the stream, the rest is data. The frame
+//is forwarded to the peer as is.
+func ConsumeRelayFrame(c *Client, frame []byte) {
+	if len(frame) < IdLength {
+		relayMetrics.Add("dropped", 1)
+		return
+	}
+	relays := c.Hub.cluster.relays
+	s := relays.get(string(frame[:IdLength]), c.Name)
+	if s == nil {
+		relayMetrics.Add("dropped", 1)
+		return
+	}
+	if !relays.allow(c, s, randomId(IdLength), len(frame)-IdLength) {
+		return
+	}
+	peer := relayPeer(c, s)
+	if peer == nil {
+		return
+	}
+	if !peer.SendBinary(frame) {
+		// lost frame breaks the stream, both parties learn it is closed
+		relayMetrics.Add("dropped", 1)
+		reason := "peer doesn't read relayed data in time"
+		closeRelay(c, s, reason)
+		sendRelayEvent(c, randomId(IdLength), EVENT_RELAY_CLOSE,
+			RelayPayload{Stream: s.id, Peer: peer.Name, Reason: reason})
+		return
+	}
+	relayMetrics.Add("frames", 1)
+	relayMetrics.Add("bytes", int64(len(frame)-IdLength))
+}
+
+//relayPeer - returns the other party of the stream, the stream is
+//closed if the party left the hub.
+func relayPeer(c *Client, s *relayStream) *Client {
+	if c.Hub.ID == s.hub {
+		if peer := c.Hub.Get(s.peer(c.Name)); peer != nil {
+			return peer
+		}
+	}
+	closeRelay(c, s, "peer left the hub")
+	return nil
+}
+
+func consumeRelayOpen(c *Client, event Event) {
+	addressee := c.Hub.Get(event.To)
+	if addressee == nil || addressee == c {
+		clientNotFound(c, event.To, event.Id)
+		return
+	}
+	s := c.Hub.cluster.relays.open(c.Hub.ID, c.Name, addressee.Name)
+	if s == nil {
+		sendError(c, event.Id, ERROR_RELAY_LIMIT, "Too many relay streams")
+		return
+	}
+	log.Printf("Relay stream %s opened between %s and %s", s.id, c.Name, addressee.Name)
+	sendRelayEvent(addressee, randomId(IdLength), EVENT_RELAY_OPEN, RelayPayload{Stream: s.id, Peer: c.Name})
+	sendRelayEvent(c, event.Id, EVENT_RELAY_OPEN, RelayPayload{Stream: s.id, Peer: addressee.Name})
+}
+
+//consumeRelayData - relays JSON data event, used by clients which
+//can't send binary frames.
+func consumeRelayData(c *Client, event Event) {
+	var payload RelayPayload
+	if event.Payload != nil {
+		if err := jsoniter.Unmarshal(*event.Payload, &payload); err != nil {
+			log.Println("consumeRelayData", err)
+		}
+	}
+	relays := c.Hub.cluster.relays
+	s := relays.get(payload.Stream, c.Name)
+	if s == nil {
+		relayNotFound(c, payload.Stream, event.Id)
+		return
+	}
+	if !relays.allow(c, s, event.Id, len(payload.Data)) {
+		return
+	}
+	peer := relayPeer(c, s)
+	if peer == nil {
+		return
+	}
+	sendRelayEvent(peer, event.Id, EVENT_RELAY_DATA, RelayPayload{Stream: s.id, Peer: c.Name, Data: payload.Data})
+	relayMetrics.Add("frames", 1)
+	relayMetrics.Add("bytes", int64(len(payload.Data)))
+}
+
+func consumeRelayClose(c *Client, event Event) {
+	var payload RelayPayload
+	if event.Payload != nil {
+		if err := jsoniter.Unmarshal(*event.Payload, &payload); err != nil {
+			log.Println("consumeRelayClose", err)
+		}
+	}
+	s := c.Hub.cluster.relays.get(payload.Stream, c.Name)
+	if s == nil {
+		relayNotFound(c, payload.Stream, event.Id)
+		return
+	}
+	closeRelay(c, s, payload.Reason)
+	confirmAction(c, event.Id)
+}
+
+//closeRelay - closes stream on behalf of c and notifies the peer.
+func closeRelay(c *Client, s *relayStream, reason string) {
+	if c.Hub.cluster.relays.close(s.id) == nil {
+		return
+	}
+	log.Printf("Relay stream %s closed by %s", s.id, c.Name)
+	if peer := c.Hub.cluster.FindClient(s.peer(c.Name)); peer != nil {
+		sendRelayEvent(peer, randomId(IdLength), EVENT_RELAY_CLOSE,
+			RelayPayload{Stream: s.id, Peer: c.Name, Reason: reason})
+	}
+}
+
+//dropRelays - closes streams of disconnected client.
+func dropRelays(cluster *Cluster, name string) {
+	for _, s := range cluster.relays.drop(name) {
+		if peer := cluster.FindClient(s.peer(name)); peer != nil {
+			sendRelayEvent(peer, randomId(IdLength), EVENT_RELAY_CLOSE,
+				RelayPayload{Stream: s.id, Peer: name, Reason: "peer disconnected"})
+		}
+	}
+}
+
+func sendRelayEvent(c *Client, id string, action string, payload RelayPayload) {
+	bts, err := jsoniter.Marshal(EventRelay{
+		EventHead: &EventHead{
+			Id:     id,
+			Action: action,
+			To:     c.Name,
+		},
+		Payload: payload,
+	})
+	if err != nil {
+		log.Println("sendRelayEvent", err)
+		return
+	}
+	c.Send(bts)
+}
+
+func relayNotFound(c *Client, stream string, id string) {
+	sendError(c, id, ERROR_RELAY_NOT_FOUND, fmt.Sprintf("Relay stream %s not found", stream))
+}
@@ -0,0 +1,297 @@
+package room
+
+import (
+	"errors"
+	"fmt"
+	"github.com/json-iterator/go"
+	"github.com/pion/sdp/v3"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SDP_VALIDATION_OFF        = "off"
+	SDP_VALIDATION_PERMISSIVE = "permissive"
+	SDP_VALIDATION_BASIC      = "basic"
+	SDP_VALIDATION_STRICT     = "strict"
+)
+
+//SDPInspector - observes and validates session descriptions relayed
+//between clients, returned error rejects the event.
+type SDPInspector func(c *Client, to *Client, event Event, summary SDPSummary) error
+
+//MediaSummary - description of single m= section.
+type MediaSummary struct {
+	Kind      string   `json:"kind"`
+	Mid       string   `json:"mid,omitempty"`
+	Port      int      `json:"port"`
+	Protocol  string   `json:"protocol"`
+	Direction string   `json:"direction,omitempty"`
+	Codecs    []string `json:"codecs,omitempty"`
+}
+
+//SDPSummary - essentials extracted from offer or answer.
+type SDPSummary struct {
+	Type        string         `json:"type,omitempty"`
+	ICEUfrag    string         `json:"iceUfrag,omitempty"`
+	Fingerprint string         `json:"fingerprint,omitempty"`
+	Media       []MediaSummary `json:"media"`
+}
+
+//SDPRecord - last session description relayed between two clients.
+type SDPRecord struct {
+	From    string     `json:"from"`
+	To      string     `json:"to"`
+	Hub     string     `json:"hub"`
+	Action  string     `json:"action"`
+	At      int64      `json:"at"`
+	Summary SDPSummary `json:"summary"`
+}
+
+//SDPLog - latest relayed session descriptions per directed pair.
+//Validation is the level used in hubs which don't set their own.
+type SDPLog struct {
+	mx         sync.RWMutex
+	records    map[[2]string]SDPRecord
+	inspectors []SDPInspector
+	validation string
+}
+
+func NewSDPLog() *SDPLog {
+	return &SDPLog{
+		records:    make(map[[2]string]SDPRecord),
+		validation: SDP_VALIDATION_PERMISSIVE,
+	}
+}
+
+//SetValidation - sets server default level, unknown level is rejected.
+func (l *SDPLog) SetValidation(level string) error {
+	if err := checkSDPValidation(level); err != nil {
+		return err
+	}
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	l.validation = level
+	return nil
+}
+
+func checkSDPValidation(level string) error {
+	switch level {
+	case SDP_VALIDATION_OFF, SDP_VALIDATION_PERMISSIVE, SDP_VALIDATION_BASIC, SDP_VALIDATION_STRICT:
+		return nil
+	}
+	return fmt.Errorf("Unknown SDP validation level %s", level)
+}
+
+//ValidateSDP - checks SDP validation level of hub to be created, empty
+//level means server default.
+func (options HubOptions) ValidateSDP() error {
+	if options.SDPValidation == "" {
+		return nil
+	}
+	return checkSDPValidation(options.SDPValidation)
+}
+
+//level - validation level of the hub, server default if not set.
+func (l *SDPLog) level(hub *Hub) string {
+	if hub.Options.SDPValidation != "" {
+		return hub.Options.SDPValidation
+	}
+	l.mx.RLock()
+	defer l.mx.RUnlock()
+	return l.validation
+}
+
+func (l *SDPLog) Use(inspector SDPInspector) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	l.inspectors = append(l.inspectors, inspector)
+}
+
+func (l *SDPLog) All() []SDPRecord {
+	l.mx.RLock()
+	defer l.mx.RUnlock()
+	result := make([]SDPRecord, 0, len(l.records))
+	for _, record := range l.records {
+		result = append(result, record)
+	}
+	return result
+}
+
+func (l *SDPLog) add(record SDPRecord) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	l.records[[2]string{record.From, record.To}] = record
+}
+
+func (l *SDPLog) drop(name string) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	for key := range l.records {
+		if key[0] == name || key[1] == name {
+			delete(l.records, key)
+		}
+	}
+}
+
+func (l *SDPLog) inspect(c *Client, to *Client, event Event, summary SDPSummary) error {
+	l.mx.RLock()
+	inspectors := l.inspectors
+	l.mx.RUnlock()
+	for _, inspector := range inspectors {
+		if err := inspector(c, to, event, summary); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//findDescription - looks for RTCSessionDescription like object with
+//sdp string field in decoded event payload, it could be the payload
+//itself or nested into it.
+func findDescription(v interface{}) map[string]interface{} {
+	node, ok := v.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	if _, ok := node["sdp"].(string); ok {
+		return node
+	}
+	for _, key := range []string{"sdp", "description", "desc"} {
+		if desc := findDescription(node[key]); desc != nil {
+			return desc
+		}
+	}
+	return nil
+}
+
+//ParseSDP - parses session description and builds its summary.
+func ParseSDP(raw string) (*sdp.SessionDescription, SDPSummary, error) {
+	var desc sdp.SessionDescription
+	var summary SDPSummary
+	if err := desc.UnmarshalString(raw); err != nil {
+		return nil, summary, err
+	}
+	summary.ICEUfrag, _ = desc.Attribute("ice-ufrag")
+	summary.Fingerprint, _ = desc.Attribute("fingerprint")
+	summary.Media = make([]MediaSummary, 0, len(desc.MediaDescriptions))
+	for _, media := range desc.MediaDescriptions {
+		m := MediaSummary{
+			Kind:     media.MediaName.Media,
+			Port:     media.MediaName.Port.Value,
+			Protocol: strings.Join(media.MediaName.Protos, "/"),
+		}
+		for _, attr := range media.Attributes {
+			switch attr.Key {
+			case "mid":
+				m.Mid = attr.Value
+			case "sendrecv", "sendonly", "recvonly", "inactive":
+				m.Direction = attr.Key
+			case "rtpmap":
+				if i := strings.IndexByte(attr.Value, ' '); i > 0 {
+					m.Codecs = append(m.Codecs, attr.Value[i+1:])
+				}
+			case "ice-ufrag":
+				if summary.ICEUfrag == "" {
+					summary.ICEUfrag = attr.Value
+				}
+			case "fingerprint":
+				if summary.Fingerprint == "" {
+					summary.Fingerprint = attr.Value
+				}
+			}
+		}
+		summary.Media = append(summary.Media, m)
+	}
+	return &desc, summary, nil
+}
+
+func validateSDP(summary SDPSummary, action string, level string) error {
+	if level != SDP_VALIDATION_STRICT {
+		return nil
+	}
+	expected := "offer"
+	if action == EVENT_ANSWER_CONNECTION {
+		expected = "answer"
+	}
+	if summary.Type != "" && summary.Type != expected && summary.Type != "pranswer" {
+		return fmt.Errorf("description type %s doesn't match %s", summary.Type, action)
+	}
+	if len(summary.Media) == 0 {
+		return errors.New("description has no media sections")
+	}
+	if summary.ICEUfrag == "" {
+		return errors.New("description has no ice-ufrag")
+	}
+	if summary.Fingerprint == "" {
+		return errors.New("description has no DTLS fingerprint")
+	}
+	for _, m := range summary.Media {
+		if m.Kind != "application" && m.Port != 0 && len(m.Codecs) == 0 {
+			return fmt.Errorf("media section %s has no codecs", m.Mid)
+		}
+	}
+	return nil
+}
+
+//inspectSDP - validates offer or answer relayed from c to addressee
+//according to hub settings, returns false if the event is rejected.
+//Permissive level only records descriptions it can parse.
+func inspectSDP(c *Client, addressee *Client, event *Event) bool {
+	sdpLog := c.Hub.cluster.sdp
+	level := sdpLog.level(c.Hub)
+	if level == SDP_VALIDATION_OFF || event.Payload == nil {
+		return true
+	}
+	permissive := level != SDP_VALIDATION_BASIC && level != SDP_VALIDATION_STRICT
+	var payload interface{}
+	if err := jsoniter.Unmarshal(*event.Payload, &payload); err != nil {
+		if permissive {
+			return true
+		}
+		invalidSDP(c, err, event.Id)
+		return false
+	}
+	desc := findDescription(payload)
+	if desc == nil {
+		if level == SDP_VALIDATION_STRICT {
+			invalidSDP(c, errors.New("no session description in payload"), event.Id)
+			return false
+		}
+		return true
+	}
+	_, summary, err := ParseSDP(desc["sdp"].(string))
+	if err != nil {
+		if permissive {
+			return true
+		}
+		invalidSDP(c, err, event.Id)
+		return false
+	}
+	summary.Type, _ = desc["type"].(string)
+	if err := validateSDP(summary, event.Action, level); err != nil {
+		invalidSDP(c, err, event.Id)
+		return false
+	}
+	if err := sdpLog.inspect(c, addressee, *event, summary); err != nil {
+		invalidSDP(c, err, event.Id)
+		return false
+	}
+	sdpLog.add(SDPRecord{
+		From:    c.Name,
+		To:      addressee.Name,
+		Hub:     c.Hub.ID,
+		Action:  event.Action,
+		At:      time.Now().Unix(),
+		Summary: summary,
+	})
+	log.Printf("SDP %s from %s to %s: %d media, ufrag %s", summary.Type, c.Name, addressee.Name,
+		len(summary.Media), summary.ICEUfrag)
+	return true
+}
+
+func invalidSDP(c *Client, reason error, id string) {
+	sendError(c, id, ERROR_INVALID_SDP, fmt.Sprintf("Invalid session description: %s", reason))
+}
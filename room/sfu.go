@@ -0,0 +1,258 @@
+package room
+
+import (
+	"fmt"
+	"github.com/json-iterator/go"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+	"log"
+	"sync"
+)
+
+const (
+	EVENT_TRACK_PUBLISHED   = "EVENT_TRACK_PUBLISHED"
+	EVENT_TRACK_UNPUBLISHED = "EVENT_TRACK_UNPUBLISHED"
+
+	DefaultSFUName = "sfu"
+)
+
+type EventTrack struct {
+	*EventHead
+	Payload TrackPayload `json:"payload"`
+}
+
+//TrackPayload - track forwarded by SFU, subscribers receive it in
+//media stream with id of the publisher.
+type TrackPayload struct {
+	Publisher string `json:"publisher"`
+	Track     string `json:"track"`
+	Kind      string `json:"kind"`
+}
+
+//publication - track published by a client and forwarded to other
+//members of its hub.
+type publication struct {
+	TrackPayload
+	hub     string
+	ssrc    uint32
+	local   *webrtc.TrackLocalStaticRTP
+	senders map[string]*webrtc.RTPSender
+}
+
+//SFU - forwards tracks published by clients of hubs in SFU mode to
+//the rest of the hub members.
+type SFU struct {
+	bot          *Bot
+	mx           sync.Mutex
+	publications map[string][]*publication
+}
+
+//NewSFU - creates selective forwarding unit answering offers sent to
+//the name by clients of hubs with SFU option.
+func NewSFU(name string, cluster *Cluster) (*Bot, error) {
+	if name == "" {
+		name = DefaultSFUName
+	}
+	api, err := newMediaAPI()
+	if err != nil {
+		return nil, err
+	}
+	sfu := &SFU{
+		publications: make(map[string][]*publication),
+	}
+	sfu.bot = NewBot(name, cluster)
+	sfu.bot.api = api
+	sfu.bot.hooks = botHooks{
+		admit:    sfu.admit,
+		answered: sfu.subscribeAll,
+		track:    sfu.publish,
+		dropped:  sfu.unsubscribe,
+	}
+	return sfu.bot, nil
+}
+
+func (sfu *SFU) admit(c *Client) error {
+	if !c.Hub.Options.SFU {
+		return fmt.Errorf("Hub %s is not in SFU mode", c.Hub.ID)
+	}
+	return nil
+}
+
+//subscribe - adds track of the publication to connection with peer,
+//returns false if it's already there. Caller holds the lock.
+func (sfu *SFU) subscribe(peer *BotPeer, pub *publication) bool {
+	if pub.Publisher == peer.Name || pub.senders[peer.Name] != nil {
+		return false
+	}
+	sender, err := peer.pc.AddTrack(pub.local)
+	if err != nil {
+		log.Printf("SFU can't forward track %s of %s to %s: %s", pub.Track, pub.Publisher, peer.Name, err)
+		return false
+	}
+	pub.senders[peer.Name] = sender
+	go sfu.readRTCP(pub, sender)
+	return true
+}
+
+//subscribeAll - forwards tracks already published in the hub to the
+//peer after its offer is answered.
+func (sfu *SFU) subscribeAll(peer *BotPeer) {
+	sfu.mx.Lock()
+	added := false
+	for _, pub := range sfu.publications[peer.Hub] {
+		if sfu.subscribe(peer, pub) {
+			added = true
+			go sfu.keyframe(pub)
+		}
+	}
+	sfu.mx.Unlock()
+	if added {
+		peer.Renegotiate()
+	}
+}
+
+//publish - announces incoming track and forwards its packets to every
+//other SFU peer of the hub until the track ends.
+func (sfu *SFU) publish(peer *BotPeer, remote *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+	if hub := sfu.bot.cluster.Get(peer.Hub); hub != nil && hub.isViewer(peer.Name) {
+		log.Printf("SFU ignores track of viewer %s in hub %s", peer.Name, peer.Hub)
+		return
+	}
+	local, err := webrtc.NewTrackLocalStaticRTP(remote.Codec().RTPCodecCapability, remote.ID(), peer.Name)
+	if err != nil {
+		log.Printf("SFU can't publish track of %s: %s", peer.Name, err)
+		return
+	}
+	pub := &publication{
+		TrackPayload: TrackPayload{
+			Publisher: peer.Name,
+			Track:     remote.ID(),
+			Kind:      remote.Kind().String(),
+		},
+		hub:     peer.Hub,
+		ssrc:    uint32(remote.SSRC()),
+		local:   local,
+		senders: make(map[string]*webrtc.RTPSender),
+	}
+	sfu.mx.Lock()
+	for _, published := range sfu.publications[peer.Hub] {
+		if published.Publisher == pub.Publisher && published.Track == pub.Track {
+			// only the first simulcast layer is forwarded
+			sfu.mx.Unlock()
+			return
+		}
+	}
+	sfu.publications[peer.Hub] = append(sfu.publications[peer.Hub], pub)
+	var subscribers []*BotPeer
+	for _, subscriber := range sfu.bot.Peers(peer.Hub) {
+		if sfu.subscribe(subscriber, pub) {
+			subscribers = append(subscribers, subscriber)
+		}
+	}
+	sfu.mx.Unlock()
+	log.Printf("SFU publishes %s track %s of %s in hub %s", pub.Kind, pub.Track, pub.Publisher, pub.hub)
+	sfu.announce(pub, EVENT_TRACK_PUBLISHED)
+	for _, subscriber := range subscribers {
+		subscriber.Renegotiate()
+	}
+	failing := false
+	for {
+		packet, _, err := remote.ReadRTP()
+		if err != nil {
+			break
+		}
+		// error of one subscriber doesn't stop forwarding to the others,
+		// it is logged when writes start and stop failing
+		if err := local.WriteRTP(packet); err != nil && !failing {
+			failing = true
+			log.Printf("SFU can't forward track %s of %s: %s", pub.Track, pub.Publisher, err)
+		} else if err == nil && failing {
+			failing = false
+			log.Printf("SFU forwards track %s of %s again", pub.Track, pub.Publisher)
+		}
+	}
+	sfu.unpublish(pub)
+}
+
+//unpublish - stops forwarding of the ended track.
+func (sfu *SFU) unpublish(pub *publication) {
+	sfu.mx.Lock()
+	list := sfu.publications[pub.hub]
+	for i, published := range list {
+		if published == pub {
+			sfu.publications[pub.hub] = append(list[:i:i], list[i+1:]...)
+			break
+		}
+	}
+	if len(sfu.publications[pub.hub]) == 0 {
+		delete(sfu.publications, pub.hub)
+	}
+	senders := pub.senders
+	pub.senders = make(map[string]*webrtc.RTPSender)
+	sfu.mx.Unlock()
+	for name, sender := range senders {
+		peer := sfu.bot.Peer(name)
+		if peer == nil {
+			continue
+		}
+		if err := peer.pc.RemoveTrack(sender); err != nil {
+			log.Printf("SFU can't remove track %s from %s: %s", pub.Track, name, err)
+			continue
+		}
+		peer.Renegotiate()
+	}
+	log.Printf("SFU unpublishes track %s of %s in hub %s", pub.Track, pub.Publisher, pub.hub)
+	sfu.announce(pub, EVENT_TRACK_UNPUBLISHED)
+}
+
+//unsubscribe - forgets senders of the dropped peer, its own tracks end
+//together with the connection.
+func (sfu *SFU) unsubscribe(peer *BotPeer) {
+	sfu.mx.Lock()
+	defer sfu.mx.Unlock()
+	for _, pub := range sfu.publications[peer.Hub] {
+		delete(pub.senders, peer.Name)
+	}
+}
+
+//readRTCP - passes keyframe requests of the subscriber to the publisher.
+func (sfu *SFU) readRTCP(pub *publication, sender *webrtc.RTPSender) {
+	for {
+		packets, _, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+		for _, packet := range packets {
+			switch packet.(type) {
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				sfu.keyframe(pub)
+			}
+		}
+	}
+}
+
+//keyframe - asks publisher of the video track for a keyframe.
+func (sfu *SFU) keyframe(pub *publication) {
+	if pub.Kind != webrtc.RTPCodecTypeVideo.String() {
+		return
+	}
+	if peer := sfu.bot.Peer(pub.Publisher); peer != nil {
+		peer.pc.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: pub.ssrc}})
+	}
+}
+
+func (sfu *SFU) announce(pub *publication, action string) {
+	bts, err := jsoniter.Marshal(EventTrack{
+		EventHead: &EventHead{
+			Id:     randomId(IdLength),
+			Action: action,
+			To:     TO_EVERYONE,
+		},
+		Payload: pub.TrackPayload,
+	})
+	if err != nil {
+		log.Println("SFU announce", err)
+		return
+	}
+	sfu.bot.cluster.Emit(bts, pub.hub)
+}
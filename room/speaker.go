@@ -0,0 +1,247 @@
+package room
+
+import (
+	"github.com/json-iterator/go"
+	"log"
+	"math"
+	"time"
+)
+
+const (
+	EVENT_AUDIO_LEVEL    = "EVENT_AUDIO_LEVEL"
+	EVENT_ACTIVE_SPEAKER = "EVENT_ACTIVE_SPEAKER"
+	EVENT_SPOTLIGHT      = "EVENT_SPOTLIGHT"
+
+	AudioLevelInterval    = time.Millisecond * 200
+	SpeechThreshold       = 0.05
+	SpeakerSmoothing      = 0.3
+	SpeakerSilenceTimeout = time.Second
+	SpeakerSwitchRatio    = 1.5
+	SpeakerHoldTime       = time.Millisecond * 600
+)
+
+type EventActiveSpeaker struct {
+	*EventHead
+	Payload ActiveSpeakerPayload `json:"payload"`
+}
+
+//AudioLevelPayload - audio level of the client microphone from 0 to 1.
+type AudioLevelPayload struct {
+	Level float64 `json:"level"`
+}
+
+//ActiveSpeakerPayload - dominant speaker of the hub and participant
+//pinned by moderator. Active is the one clients should highlight.
+type ActiveSpeakerPayload struct {
+	Speaker   string `json:"speaker,omitempty"`
+	Spotlight string `json:"spotlight,omitempty"`
+	Active    string `json:"active,omitempty"`
+}
+
+type SpotlightPayload struct {
+	Name string `json:"name"`
+}
+
+type audioLevel struct {
+	energy   float64
+	reported time.Time
+}
+
+//speakerState - dominant speaker election, owned by the hub goroutine.
+type speakerState struct {
+	levels         map[string]*audioLevel
+	dominant       string
+	spotlight      string
+	challenger     string
+	challengeSince time.Time
+}
+
+func newSpeakerState() *speakerState {
+	return &speakerState{
+		levels: make(map[string]*audioLevel),
+	}
+}
+
+//energy - smoothed level of the client, zero if it stopped reporting.
+func (s *speakerState) energy(name string, now time.Time) float64 {
+	level := s.levels[name]
+	if level == nil || now.Sub(level.reported) > SpeakerSilenceTimeout {
+		return 0
+	}
+	return level.energy
+}
+
+//speakerLevel - stores reported level and elects dominant speaker.
+//Reports more frequent than AudioLevelInterval are ignored.
+func (hub *Hub) speakerLevel(name string, value float64) {
+	now := time.Now()
+	s := hub.speaker
+	level := s.levels[name]
+	if level == nil {
+		level = &audioLevel{}
+		s.levels[name] = level
+	} else if now.Sub(level.reported) < AudioLevelInterval {
+		return
+	}
+	if now.Sub(level.reported) > SpeakerSilenceTimeout {
+		level.energy = 0
+	}
+	level.energy += (value - level.energy) * SpeakerSmoothing
+	level.reported = now
+	if hub.speakerElect(now) {
+		hub.broadcastSpeaker()
+	}
+}
+
+//speakerElect - switches dominant speaker when another client stays
+//louder by SpeakerSwitchRatio for SpeakerHoldTime, returns true if the
+//speaker changed. The last speaker keeps the role during silence.
+func (hub *Hub) speakerElect(now time.Time) bool {
+	s := hub.speaker
+	loudest, loudestEnergy := "", 0.0
+	for name := range s.levels {
+		if energy := s.energy(name, now); energy >= SpeechThreshold && energy > loudestEnergy {
+			loudest, loudestEnergy = name, energy
+		}
+	}
+	if loudest == "" || loudest == s.dominant {
+		s.challenger = ""
+		return false
+	}
+	if s.dominant != "" && loudestEnergy <= s.energy(s.dominant, now)*SpeakerSwitchRatio {
+		s.challenger = ""
+		return false
+	}
+	if s.dominant != "" {
+		if s.challenger != loudest {
+			s.challenger = loudest
+			s.challengeSince = now
+			return false
+		}
+		if now.Sub(s.challengeSince) < SpeakerHoldTime {
+			return false
+		}
+	}
+	s.dominant = loudest
+	s.challenger = ""
+	return true
+}
+
+func (hub *Hub) speakerSpotlight(name string) {
+	if hub.speaker.spotlight == name {
+		return
+	}
+	hub.speaker.spotlight = name
+	hub.broadcastSpeaker()
+}
+
+//speakerLeave - forgets the client, clears its roles.
+func (hub *Hub) speakerLeave(name string) {
+	s := hub.speaker
+	delete(s.levels, name)
+	if s.challenger == name {
+		s.challenger = ""
+	}
+	if s.dominant != name && s.spotlight != name {
+		return
+	}
+	if s.dominant == name {
+		s.dominant = ""
+	}
+	if s.spotlight == name {
+		s.spotlight = ""
+	}
+	hub.broadcastSpeaker()
+}
+
+func (hub *Hub) speakerPayload() ActiveSpeakerPayload {
+	payload := ActiveSpeakerPayload{
+		Speaker:   hub.speaker.dominant,
+		Spotlight: hub.speaker.spotlight,
+		Active:    hub.speaker.dominant,
+	}
+	if payload.Spotlight != "" {
+		payload.Active = payload.Spotlight
+	}
+	return payload
+}
+
+func (hub *Hub) broadcastSpeaker() {
+	bts, err := activeSpeaker(TO_EVERYONE, hub.speakerPayload())
+	if err != nil {
+		log.Println("broadcastSpeaker", err)
+		return
+	}
+	for _, client := range hub.pool {
+		client.Send(bts)
+	}
+}
+
+//sendSpeaker - gives just joined client current speaker and spotlight.
+func (hub *Hub) sendSpeaker(c *Client) {
+	payload := hub.speakerPayload()
+	if payload.Active == "" {
+		return
+	}
+	bts, err := activeSpeaker(c.Name, payload)
+	if err != nil {
+		log.Println("sendSpeaker", err)
+		return
+	}
+	c.Send(bts)
+}
+
+func activeSpeaker(to string, payload ActiveSpeakerPayload) ([]byte, error) {
+	return jsoniter.Marshal(EventActiveSpeaker{
+		EventHead: &EventHead{
+			Id:     randomId(IdLength),
+			Action: EVENT_ACTIVE_SPEAKER,
+			To:     to,
+		},
+		Payload: payload,
+	})
+}
+
+//consumeAudioLevel - takes periodic level report, it isn't confirmed
+//to keep the traffic low.
+func consumeAudioLevel(c *Client, event Event) {
+	var payload AudioLevelPayload
+	if event.Payload != nil {
+		if err := jsoniter.Unmarshal(*event.Payload, &payload); err != nil {
+			log.Println("consumeAudioLevel", err)
+			return
+		}
+	}
+	if math.IsNaN(payload.Level) || c.Hub.isViewer(c.Name) {
+		return
+	}
+	c.Hub.listener <- commandData{
+		action: speakerLevel,
+		key:    c.Name,
+		level:  math.Max(0, math.Min(1, payload.Level)),
+	}
+}
+
+func consumeSpotlight(c *Client, event Event) {
+	var payload SpotlightPayload
+	if event.Payload != nil {
+		if err := jsoniter.Unmarshal(*event.Payload, &payload); err != nil {
+			log.Println("consumeSpotlight", err)
+		}
+	}
+	if !c.Hub.IsOwner(c.Name) {
+		notHubOwner(c, c.Hub.ID, event.Id)
+		return
+	}
+	if payload.Name != "" && c.Hub.Get(payload.Name) == nil {
+		clientNotFound(c, payload.Name, event.Id)
+		return
+	}
+	c.Hub.listener <- commandData{
+		action: speakerSpotlight,
+		key:    c.Name,
+		peer:   payload.Name,
+	}
+	log.Printf("Client %s set spotlight on %q in hub %s", c.Name, payload.Name, c.Hub.ID)
+	confirmAction(c, event.Id)
+}
@@ -0,0 +1,216 @@
+package room
+
+import (
+	"fmt"
+	"github.com/json-iterator/go"
+	"log"
+	"sync"
+)
+
+const (
+	EVENT_STAGE_PROMOTE = "EVENT_STAGE_PROMOTE"
+	EVENT_STAGE_DEMOTE  = "EVENT_STAGE_DEMOTE"
+	EVENT_STAGE_ROLE    = "EVENT_STAGE_ROLE"
+
+	ROLE_PUBLISHER = "publisher"
+	ROLE_VIEWER    = "viewer"
+)
+
+type EventStageRole struct {
+	*EventHead
+	Payload StageRolePayload `json:"payload"`
+}
+
+//StageRolePayload - client promoted to stage or demoted to viewers.
+type StageRolePayload struct {
+	Name string `json:"name"`
+	Role string `json:"role,omitempty"`
+}
+
+//stageState - publishers of stage hub. Changed by the hub goroutine,
+//read by consumers of any client.
+type stageState struct {
+	mx         sync.Mutex
+	publishers map[string]bool
+}
+
+func newStageState(publishers []string) *stageState {
+	s := &stageState{
+		publishers: make(map[string]bool),
+	}
+	for _, name := range publishers {
+		s.publishers[name] = true
+	}
+	return s
+}
+
+func (s *stageState) has(name string) bool {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.publishers[name]
+}
+
+//set - returns false if the client already had the role.
+func (s *stageState) set(name string, publisher bool) bool {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if s.publishers[name] == publisher {
+		return false
+	}
+	if publisher {
+		s.publishers[name] = true
+	} else {
+		delete(s.publishers, name)
+	}
+	return true
+}
+
+//isViewer - reports whether client with the name may only receive
+//media in the stage hub.
+func (hub *Hub) isViewer(name string) bool {
+	return hub.Options.Stage && !hub.IsOwner(name) && !hub.stage.has(name)
+}
+
+//visible - reports whether client a may know about client b, viewers of
+//stage hub don't see each other.
+func (hub *Hub) visible(a string, b string) bool {
+	return a == b || !hub.isViewer(a) || !hub.isViewer(b)
+}
+
+func (hub *Hub) visibleTo(name string, names []string) []string {
+	if !hub.Options.Stage {
+		return names
+	}
+	result := make([]string, 0, len(names))
+	for _, other := range names {
+		if hub.visible(name, other) {
+			result = append(result, other)
+		}
+	}
+	return result
+}
+
+//stageRole - changes role of the client and tells the hub about it.
+//Tracks announced by demoted client are removed. Other viewers learn
+//about promoted client as about connected one, demoted client is
+//removed for them.
+func (hub *Hub) stageRole(name string, publisher bool) {
+	if !hub.stage.set(name, publisher) {
+		return
+	}
+	if !publisher {
+		for id := range hub.media.tracks[name] {
+			hub.mediaRemove(name, id)
+		}
+	}
+	bts, err := jsoniter.Marshal(EventStageRole{
+		EventHead: &EventHead{
+			Id:     randomId(IdLength),
+			Action: EVENT_STAGE_ROLE,
+			To:     TO_EVERYONE,
+		},
+		Payload: StageRolePayload{
+			Name: name,
+			Role: hub.RoleOf(name),
+		},
+	})
+	if err != nil {
+		log.Println("stageRole", err)
+		return
+	}
+	presence := getClientRemoved(name)
+	if publisher {
+		presence = getClientConnected(name)
+	}
+	for _, client := range hub.pool {
+		if client.Name == name || !hub.isViewer(client.Name) {
+			client.Send(bts)
+			continue
+		}
+		if presence != nil {
+			client.Send(presence)
+		}
+		if publisher {
+			client.Send(bts)
+		}
+	}
+}
+
+//EmitAbout - sends message concerning client with the name to every
+//hub member allowed to see that client.
+func (hub *Hub) EmitAbout(name string, msg []byte) {
+	hub.listener <- commandData{
+		action: emit,
+		key:    name,
+		data:   msg,
+	}
+}
+
+//stageAllows - checks direct event between members of stage hub, only
+//publishers may offer media and viewers can't reach each other.
+func stageAllows(c *Client, event Event) bool {
+	hub := c.Hub
+	if !hub.Options.Stage || !hub.isViewer(c.Name) {
+		return true
+	}
+	if hub.cluster.IsReserved(event.To) {
+		// viewers receive media of SFU through their own offers
+		return true
+	}
+	if hub.isViewer(event.To) {
+		clientNotFound(c, event.To, event.Id)
+		return false
+	}
+	if event.Action == EVENT_OFFER_CONNECTION {
+		notPublisher(c, hub.ID, event.Id)
+		return false
+	}
+	return true
+}
+
+func consumeStagePromote(c *Client, event Event) {
+	consumeStageRole(c, event, true)
+}
+
+func consumeStageDemote(c *Client, event Event) {
+	consumeStageRole(c, event, false)
+}
+
+func consumeStageRole(c *Client, event Event, publisher bool) {
+	var payload StageRolePayload
+	if event.Payload != nil {
+		if err := jsoniter.Unmarshal(*event.Payload, &payload); err != nil {
+			log.Println("consumeStageRole", err)
+		}
+	}
+	if !c.Hub.IsOwner(c.Name) {
+		notHubOwner(c, c.Hub.ID, event.Id)
+		return
+	}
+	if !c.Hub.Options.Stage {
+		sendError(c, event.Id, ERROR_NOT_PUBLISHER, fmt.Sprintf("Hub %s is not a stage", c.Hub.ID))
+		return
+	}
+	if c.Hub.Get(payload.Name) == nil {
+		clientNotFound(c, payload.Name, event.Id)
+		return
+	}
+	if c.Hub.IsOwner(payload.Name) {
+		sendError(c, event.Id, ERROR_NOT_PUBLISHER, fmt.Sprintf("Owner %s always stays on stage", payload.Name))
+		return
+	}
+	action := stagePromote
+	if !publisher {
+		action = stageDemote
+	}
+	c.Hub.listener <- commandData{
+		action: action,
+		key:    payload.Name,
+	}
+	log.Printf("Client %s changed stage role of %s in hub %s", c.Name, payload.Name, c.Hub.ID)
+	confirmAction(c, event.Id)
+}
+
+func notPublisher(c *Client, hubID string, id string) {
+	sendError(c, id, ERROR_NOT_PUBLISHER, fmt.Sprintf("Only publishers may send media on stage of hub %s", hubID))
+}
@@ -0,0 +1,443 @@
+package room
+
+import (
+	"expvar"
+	"github.com/json-iterator/go"
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	EVENT_STATS_REPORT    = "EVENT_STATS_REPORT"
+	EVENT_QUALITY_WARNING = "EVENT_QUALITY_WARNING"
+
+	StatsRingSize       = 500
+	MaxStatsSamples     = 32
+	StatsSmoothing      = 0.3
+	StatsStaleAfter     = time.Second * 30
+	PoorQualityScore    = 3.0
+	RecoveredScoreDelta = 0.3
+)
+
+var qualityMetrics = expvar.NewMap("quality")
+
+//StatsSample - compact getStats summary of connection with the peer.
+//RTT and Jitter are in seconds, Loss is a fraction of lost packets and
+//Bitrate is bits per second of incoming media.
+type StatsSample struct {
+	Peer            string  `json:"peer"`
+	RTT             float64 `json:"rtt"`
+	Jitter          float64 `json:"jitter"`
+	Loss            float64 `json:"loss"`
+	Bitrate         int64   `json:"bitrate"`
+	LocalCandidate  string  `json:"localCandidate,omitempty"`
+	RemoteCandidate string  `json:"remoteCandidate,omitempty"`
+	From            string  `json:"from,omitempty"`
+	At              int64   `json:"at,omitempty"`
+}
+
+type StatsReportPayload struct {
+	Samples []StatsSample `json:"samples"`
+}
+
+type EventQualityWarning struct {
+	*EventHead
+	Payload QualityWarningPayload `json:"payload"`
+}
+
+//QualityWarningPayload - sent to both peers when quality of their
+//connection drops below PoorQualityScore and when it recovers.
+type QualityWarningPayload struct {
+	Peer     string  `json:"peer"`
+	Score    float64 `json:"score"`
+	Degraded bool    `json:"degraded"`
+	RTT      float64 `json:"rtt"`
+	Jitter   float64 `json:"jitter"`
+	Loss     float64 `json:"loss"`
+}
+
+//PairQuality - aggregated quality of connection between two clients,
+//the worst of both reported directions.
+type PairQuality struct {
+	Hub             string    `json:"hub"`
+	Peers           [2]string `json:"peers"`
+	Score           float64   `json:"score"`
+	Degraded        bool      `json:"degraded"`
+	RTT             float64   `json:"rtt"`
+	Jitter          float64   `json:"jitter"`
+	Loss            float64   `json:"loss"`
+	Bitrate         int64     `json:"bitrate"`
+	LocalCandidate  string    `json:"localCandidate,omitempty"`
+	RemoteCandidate string    `json:"remoteCandidate,omitempty"`
+	Samples         int       `json:"samples"`
+	UpdatedAt       int64     `json:"updatedAt"`
+}
+
+//HubQuality - quality of all reported connections in the hub.
+type HubQuality struct {
+	Hub      string        `json:"hub"`
+	Score    float64       `json:"score"`
+	MinScore float64       `json:"minScore"`
+	Degraded int           `json:"degraded"`
+	Pairs    []PairQuality `json:"pairs"`
+}
+
+//direction - smoothed samples reported by one side of the pair.
+type direction struct {
+	sample  StatsSample
+	updated time.Time
+}
+
+type pairStats struct {
+	hub        string
+	peers      [2]string
+	directions map[string]*direction
+	samples    int
+	degraded   bool
+}
+
+//statsRing - bounded buffer of the last raw samples of the hub.
+type statsRing struct {
+	samples []StatsSample
+	next    int
+}
+
+func (r *statsRing) add(sample StatsSample) {
+	if len(r.samples) < StatsRingSize {
+		r.samples = append(r.samples, sample)
+		return
+	}
+	r.samples[r.next] = sample
+	r.next = (r.next + 1) % StatsRingSize
+}
+
+func (r *statsRing) all() []StatsSample {
+	result := make([]StatsSample, 0, len(r.samples))
+	result = append(result, r.samples[r.next:]...)
+	return append(result, r.samples[:r.next]...)
+}
+
+//Stats - connection quality reported by clients, aggregated per peer
+//pair and per hub.
+type Stats struct {
+	mx    sync.Mutex
+	pairs map[[3]string]*pairStats
+	rings map[string]*statsRing
+}
+
+func NewStats() *Stats {
+	return &Stats{
+		pairs: make(map[[3]string]*pairStats),
+		rings: make(map[string]*statsRing),
+	}
+}
+
+func hubPairKey(hub string, a string, b string) [3]string {
+	if a > b {
+		a, b = b, a
+	}
+	return [3]string{hub, a, b}
+}
+
+//add - aggregates sample reported by the client, returns pair quality
+//if the pair just degraded or recovered.
+func (s *Stats) add(hub string, sample StatsSample, now time.Time) *PairQuality {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	ring := s.rings[hub]
+	if ring == nil {
+		ring = &statsRing{}
+		s.rings[hub] = ring
+	}
+	ring.add(sample)
+
+	key := hubPairKey(hub, sample.From, sample.Peer)
+	pair := s.pairs[key]
+	if pair == nil {
+		pair = &pairStats{
+			hub:        hub,
+			peers:      [2]string{key[1], key[2]},
+			directions: make(map[string]*direction),
+		}
+		s.pairs[key] = pair
+		qualityMetrics.Add("pairs", 1)
+	}
+	pair.samples++
+	d := pair.directions[sample.From]
+	if d == nil || now.Sub(d.updated) > StatsStaleAfter {
+		d = &direction{sample: sample}
+		pair.directions[sample.From] = d
+	} else {
+		d.sample = smooth(d.sample, sample)
+	}
+	d.updated = now
+
+	quality := pair.quality(now)
+	switch {
+	case !pair.degraded && quality.Score < PoorQualityScore:
+		pair.degraded = true
+		qualityMetrics.Add("degradations", 1)
+		qualityMetrics.Add("degraded", 1)
+	case pair.degraded && quality.Score >= PoorQualityScore+RecoveredScoreDelta:
+		pair.degraded = false
+		qualityMetrics.Add("degraded", -1)
+	default:
+		return nil
+	}
+	quality.Degraded = pair.degraded
+	return &quality
+}
+
+//smooth - moves averaged sample towards the new one, candidate types
+//are always taken from the latest report.
+func smooth(previous StatsSample, sample StatsSample) StatsSample {
+	mix := func(a float64, b float64) float64 {
+		return a + (b-a)*StatsSmoothing
+	}
+	sample.RTT = mix(previous.RTT, sample.RTT)
+	sample.Jitter = mix(previous.Jitter, sample.Jitter)
+	sample.Loss = mix(previous.Loss, sample.Loss)
+	sample.Bitrate = int64(mix(float64(previous.Bitrate), float64(sample.Bitrate)))
+	return sample
+}
+
+//quality - worst values of the directions reported recently.
+func (pair *pairStats) quality(now time.Time) PairQuality {
+	quality := PairQuality{
+		Hub:      pair.hub,
+		Peers:    pair.peers,
+		Degraded: pair.degraded,
+		Samples:  pair.samples,
+	}
+	bitrate := int64(-1)
+	for _, name := range pair.peers {
+		d := pair.directions[name]
+		if d == nil || now.Sub(d.updated) > StatsStaleAfter {
+			continue
+		}
+		quality.RTT = math.Max(quality.RTT, d.sample.RTT)
+		quality.Jitter = math.Max(quality.Jitter, d.sample.Jitter)
+		quality.Loss = math.Max(quality.Loss, d.sample.Loss)
+		if bitrate < 0 || d.sample.Bitrate < bitrate {
+			bitrate = d.sample.Bitrate
+		}
+		if quality.LocalCandidate == "" {
+			quality.LocalCandidate = d.sample.LocalCandidate
+			quality.RemoteCandidate = d.sample.RemoteCandidate
+		}
+		if updated := d.updated.Unix(); updated > quality.UpdatedAt {
+			quality.UpdatedAt = updated
+		}
+	}
+	if bitrate > 0 {
+		quality.Bitrate = bitrate
+	}
+	quality.Score = QualityScore(quality.RTT, quality.Jitter, quality.Loss)
+	return quality
+}
+
+//QualityScore - estimates mean opinion score from 1 to 5 with the
+//simplified E-model.
+func QualityScore(rtt float64, jitter float64, loss float64) float64 {
+	latency := rtt*1000/2 + jitter*1000*2 + 10
+	r := 93.2
+	if latency < 160 {
+		r -= latency / 40
+	} else {
+		r -= (latency - 120) / 10
+	}
+	r -= loss * 100 * 2.5
+	if r < 0 {
+		r = 0
+	}
+	if r > 100 {
+		r = 100
+	}
+	score := 1 + 0.035*r + 0.000007*r*(r-60)*(100-r)
+	return math.Round(math.Max(1, math.Min(5, score))*100) / 100
+}
+
+//All - returns quality of every hub with reported connections.
+func (s *Stats) All() []HubQuality {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	now := time.Now()
+	hubs := make(map[string]*HubQuality)
+	for _, pair := range s.pairs {
+		quality := pair.quality(now)
+		hub := hubs[pair.hub]
+		if hub == nil {
+			hub = &HubQuality{
+				Hub:      pair.hub,
+				MinScore: quality.Score,
+				Pairs:    []PairQuality{},
+			}
+			hubs[pair.hub] = hub
+		}
+		hub.Pairs = append(hub.Pairs, quality)
+		hub.Score += quality.Score
+		hub.MinScore = math.Min(hub.MinScore, quality.Score)
+		if quality.Degraded {
+			hub.Degraded++
+		}
+	}
+	result := make([]HubQuality, 0, len(hubs))
+	for _, hub := range hubs {
+		hub.Score = math.Round(hub.Score/float64(len(hub.Pairs))*100) / 100
+		sort.Slice(hub.Pairs, func(i, j int) bool {
+			return hub.Pairs[i].Score < hub.Pairs[j].Score
+		})
+		result = append(result, *hub)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Hub < result[j].Hub
+	})
+	return result
+}
+
+//Samples - returns raw samples of the hub, oldest first.
+func (s *Stats) Samples(hub string) []StatsSample {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	ring := s.rings[hub]
+	if ring == nil {
+		return []StatsSample{}
+	}
+	return ring.all()
+}
+
+//forget - deletes pairs matching the key filter, must be called with
+//the lock held.
+func (s *Stats) forget(match func(key [3]string) bool) {
+	for key, pair := range s.pairs {
+		if !match(key) {
+			continue
+		}
+		if pair.degraded {
+			qualityMetrics.Add("degraded", -1)
+		}
+		qualityMetrics.Add("pairs", -1)
+		delete(s.pairs, key)
+	}
+}
+
+//drop - forgets pairs of disconnected client.
+func (s *Stats) drop(name string) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.forget(func(key [3]string) bool {
+		return key[1] == name || key[2] == name
+	})
+}
+
+//leave - forgets pairs of client which left the hub.
+func (s *Stats) leave(hub string, name string) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.forget(func(key [3]string) bool {
+		return key[0] == hub && (key[1] == name || key[2] == name)
+	})
+}
+
+//dropHub - forgets pairs and samples of removed hub.
+func (s *Stats) dropHub(hub string) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	delete(s.rings, hub)
+	s.forget(func(key [3]string) bool {
+		return key[0] == hub
+	})
+}
+
+//valid - normalizes reported values, returns false if the sample can't
+//be used.
+func (sample *StatsSample) valid() bool {
+	values := []float64{sample.RTT, sample.Jitter, sample.Loss}
+	for _, v := range values {
+		if math.IsNaN(v) || math.IsInf(v, 0) || v < 0 {
+			return false
+		}
+	}
+	if sample.Bitrate < 0 {
+		sample.Bitrate = 0
+	}
+	sample.Loss = math.Min(sample.Loss, 1)
+	return true
+}
+
+func consumeStatsReport(c *Client, event Event) {
+	var payload StatsReportPayload
+	if event.Payload != nil {
+		if err := jsoniter.Unmarshal(*event.Payload, &payload); err != nil {
+			qualityMetrics.Add("rejected", 1)
+			sendError(c, event.Id, ERROR_INVALID_STATS, "Invalid stats report: "+err.Error())
+			return
+		}
+	}
+	if len(payload.Samples) > MaxStatsSamples {
+		payload.Samples = payload.Samples[:MaxStatsSamples]
+	}
+	cluster := c.Hub.cluster
+	now := time.Now()
+	qualityMetrics.Add("reports", 1)
+	for _, sample := range payload.Samples {
+		if sample.Peer == c.Name || !sample.valid() || !reportable(c, sample.Peer) {
+			qualityMetrics.Add("rejected", 1)
+			continue
+		}
+		sample.From = c.Name
+		sample.At = now.Unix()
+		qualityMetrics.Add("samples", 1)
+		if changed := cluster.stats.add(c.Hub.ID, sample, now); changed != nil {
+			notifyQuality(c.Hub, *changed)
+		}
+	}
+	confirmAction(c, event.Id)
+}
+
+//reportable - checks the peer of reported connection, it must be bot or
+//hub member visible to the client.
+func reportable(c *Client, peer string) bool {
+	if c.Hub.cluster.Bot(peer) != nil {
+		return true
+	}
+	return c.Hub.Get(peer) != nil && c.Hub.visible(c.Name, peer)
+}
+
+//notifyQuality - tells both peers of the pair about changed quality of
+//their connection.
+func notifyQuality(hub *Hub, quality PairQuality) {
+	if quality.Degraded {
+		log.Printf("Connection %s - %s in hub %s degraded, score %.2f",
+			quality.Peers[0], quality.Peers[1], quality.Hub, quality.Score)
+	}
+	for i, name := range quality.Peers {
+		client := hub.Get(name)
+		if client == nil {
+			continue
+		}
+		bts, err := jsoniter.Marshal(EventQualityWarning{
+			EventHead: &EventHead{
+				Id:     randomId(IdLength),
+				Action: EVENT_QUALITY_WARNING,
+				To:     name,
+			},
+			Payload: QualityWarningPayload{
+				Peer:     quality.Peers[1-i],
+				Score:    quality.Score,
+				Degraded: quality.Degraded,
+				RTT:      quality.RTT,
+				Jitter:   quality.Jitter,
+				Loss:     quality.Loss,
+			},
+		})
+		if err != nil {
+			log.Println("notifyQuality", err)
+			return
+		}
+		client.Send(bts)
+	}
+}
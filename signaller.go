@@ -1,11 +1,19 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"github.com/labstack/echo"
 	"github.com/labstack/echo/middleware"
 	"github.com/lempiy/Signaller/handlers"
+	"github.com/lempiy/Signaller/nat"
 	"github.com/lempiy/Signaller/room"
+	"net"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 func main() {
@@ -14,11 +22,155 @@ func main() {
 	e.Use(middleware.Recover())
 
 	cluster := room.NewCluster()
+	if path := os.Getenv("POLICY_FILE"); path != "" {
+		policies, err := room.LoadPolicyConfig(path)
+		if err != nil {
+			e.Logger.Fatal(err)
+		}
+		cluster.SetPolicies(policies)
+	}
+	if level := os.Getenv("SDP_VALIDATION"); level != "" {
+		if err := cluster.SetSDPValidation(level); err != nil {
+			e.Logger.Fatal(err)
+		}
+	}
 	PORT := os.Getenv("PORT")
 	if PORT == "" {
 		PORT = "4000"
 	}
+	ttl, _ := strconv.Atoi(os.Getenv("TURN_TTL"))
+	secret := os.Getenv("TURN_SECRET")
+	if secret == "" && os.Getenv("TURN_PORT") != "" {
+		secret = randomSecret()
+	}
+	cluster.SetICEConfig(room.ICEConfig{
+		STUN:   splitList(os.Getenv("STUN_URLS")),
+		TURN:   splitList(os.Getenv("TURN_URLS")),
+		Secret: secret,
+		TTL:    time.Duration(ttl) * time.Second,
+	})
+	if name, ok := os.LookupEnv("BOT_NAME"); ok {
+		cluster.EnableBot(name)
+	}
+	if name, ok := os.LookupEnv("SFU_NAME"); ok {
+		if _, err := cluster.EnableSFU(name); err != nil {
+			e.Logger.Fatal(err)
+		}
+	}
+	if dir := os.Getenv("RECORDING_DIR"); dir != "" {
+		if _, err := cluster.EnableRecorder(os.Getenv("RECORDER_NAME"), dir); err != nil {
+			e.Logger.Fatal(err)
+		}
+	}
+	if name, ok := os.LookupEnv("ECHO_NAME"); ok {
+		if _, err := cluster.EnableEcho(name); err != nil {
+			e.Logger.Fatal(err)
+		}
+	}
+	relayBandwidth, _ := strconv.Atoi(os.Getenv("RELAY_BANDWIDTH"))
+	relayStreams, _ := strconv.Atoi(os.Getenv("RELAY_MAX_STREAMS"))
+	cluster.SetRelayConfig(room.RelayConfig{
+		Bandwidth:  relayBandwidth,
+		MaxStreams: relayStreams,
+	})
+	if port := os.Getenv("STUN_PORT"); port != "" {
+		server, err := nat.ListenSTUN(":" + port)
+		if err != nil {
+			e.Logger.Fatal(err)
+		}
+		go func() {
+			e.Logger.Fatal(server.Serve())
+		}()
+		host, err := publicHost()
+		if err != nil {
+			e.Logger.Fatal(err)
+		}
+		cluster.AdvertiseSTUN("stun:" + host + ":" + port)
+	}
+	if port := os.Getenv("TURN_PORT"); port != "" {
+		maxAllocations, _ := strconv.Atoi(os.Getenv("TURN_MAX_ALLOCATIONS"))
+		bandwidth, _ := strconv.Atoi(os.Getenv("TURN_BANDWIDTH"))
+		host, err := publicHost()
+		if err != nil {
+			e.Logger.Fatal(err)
+		}
+		server, err := nat.ListenTURN(nat.TURNConfig{
+			Address:        ":" + port,
+			RelayIP:        relayIP(host),
+			Realm:          os.Getenv("TURN_REALM"),
+			Secret:         secret,
+			MaxAllocations: maxAllocations,
+			Bandwidth:      bandwidth,
+			IsConnected: func(name string) bool {
+				return cluster.FindClient(name) != nil
+			},
+		})
+		if err != nil {
+			e.Logger.Fatal(err)
+		}
+		cluster.OnClientRelease(server.Revoke)
+		cluster.AdvertiseTURN("turn:" + host + ":" + port + "?transport=udp")
+		cluster.AdvertiseTURN("turn:" + host + ":" + port + "?transport=tcp")
+	}
 	r := e.Router()
 	handlers.Run(r, cluster)
 	e.Logger.Fatal(e.Start(":" + PORT))
 }
+
+func splitList(s string) []string {
+	var result []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+//publicHost - returns host clients use to reach embedded STUN and TURN
+//servers, PUBLIC_HOST or the first non-loopback IPv4 address.
+func publicHost() (string, error) {
+	if host := os.Getenv("PUBLIC_HOST"); host != "" {
+		return host, nil
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return "", err
+	}
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.IsLoopback() || ipnet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if ip4 := ipnet.IP.To4(); ip4 != nil {
+			return ip4.String(), nil
+		}
+	}
+	return "", errors.New("PUBLIC_HOST is required, no non-loopback address found")
+}
+
+//relayIP - returns address advertised in TURN relayed candidates.
+func relayIP(host string) net.IP {
+	if ip := net.ParseIP(os.Getenv("TURN_RELAY_IP")); ip != nil {
+		return ip
+	}
+	addrs, err := net.LookupIP(host)
+	if err == nil {
+		for _, ip := range addrs {
+			if ip4 := ip.To4(); ip4 != nil {
+				return ip4
+			}
+		}
+	}
+	return net.IPv4(127, 0, 0, 1)
+}
+
+//randomSecret - generates TURN secret shared by embedded server and
+//issued credentials when none is configured.
+func randomSecret() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}